@@ -0,0 +1,110 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// An AdaptiveLevel is a policy which lowers the compression level
+// used by a handler while it is under CPU pressure and raises it
+// again as the pressure falls. It is used by setting the Adaptive
+// field of a Config.
+//
+// Each time a handler decides to compress a response it consults the
+// AdaptiveLevel. If the number of responses being compressed is at
+// least MaxInFlight, or the recent average time spent compressing a
+// response exceeds MaxLatency, the level is lowered by one step. If
+// both are below half their limits, it is raised by one step, up to
+// the handler's own level. The lowest level used is BestSpeed, unless
+// AllowIdentity is true in which case the step below BestSpeed sends
+// responses with identity encoding to clients which accept it.
+//
+// An AdaptiveLevel may be shared by several handlers, which then
+// adapt together. It must not be copied after first use.
+type AdaptiveLevel struct {
+	// MaxInFlight is the number of concurrently compressed
+	// responses at which the level is lowered. Zero means no
+	// limit.
+	MaxInFlight int
+	// MaxLatency is the average time spent compressing a response
+	// above which the level is lowered. Zero means no limit.
+	MaxLatency time.Duration
+	// AllowIdentity, if true, allows compression to be skipped
+	// altogether when the level is already BestSpeed.
+	AllowIdentity bool
+
+	mu       sync.Mutex
+	inFlight int
+	latency  time.Duration // moving average of compression time
+	steps    int           // steps the level is lowered by
+}
+
+// validate returns an error if a has invalid limits.
+func (a *AdaptiveLevel) validate() error {
+	if a.MaxInFlight < 0 || a.MaxLatency < 0 {
+		return fmt.Errorf(
+			"httpgzip: invalid adaptive level limits: %d, %v",
+			a.MaxInFlight, a.MaxLatency)
+	}
+	return nil
+}
+
+// acquire gets called when a response compressed at level is about
+// to start. It adjusts the policy's state and returns the level to
+// use instead, and whether compression should be skipped. If skip is
+// false the caller must call release when compression finishes.
+func (a *AdaptiveLevel) acquire(level int, identityOK bool) (newLevel int, skip bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	over := a.MaxInFlight > 0 && a.inFlight >= a.MaxInFlight ||
+		a.MaxLatency > 0 && a.latency > a.MaxLatency
+	under := (a.MaxInFlight == 0 || 2*a.inFlight < a.MaxInFlight) &&
+		(a.MaxLatency == 0 || 2*a.latency < a.MaxLatency)
+	base := level
+	if base == DefaultCompression {
+		// the level compress/flate uses for DefaultCompression
+		base = 6
+	}
+	maxSteps := base - BestSpeed
+	if a.AllowIdentity {
+		maxSteps++
+	}
+	switch {
+	case over && a.steps < maxSteps:
+		a.steps++
+	case under && a.steps > 0:
+		a.steps--
+	}
+	steps := a.steps
+	if steps > maxSteps {
+		// a handler with a lower level shares this policy
+		steps = maxSteps
+	}
+	switch {
+	case level == NoCompression || steps <= 0:
+		newLevel = level
+	case base-steps < BestSpeed:
+		if identityOK {
+			return level, true
+		}
+		newLevel = BestSpeed
+	default:
+		newLevel = base - steps
+	}
+	a.inFlight++
+	return newLevel, false
+}
+
+// release gets called when a compression started by acquire finishes
+// having spent d compressing.
+func (a *AdaptiveLevel) release(d time.Duration) {
+	a.mu.Lock()
+	a.inFlight--
+	a.latency += (d - a.latency) / 8
+	a.mu.Unlock()
+}
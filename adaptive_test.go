@@ -0,0 +1,110 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestAdaptiveLevel holds one compressed response open while making
+// further requests to a handler whose Config has an AdaptiveLevel
+// with MaxInFlight 1. It checks that the compression level is
+// lowered, then compression skipped, while the response is open, and
+// that the level is raised again afterwards.
+func TestAdaptiveLevel(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+	})
+	statsc := make(chan httpgzip.Stats, 1)
+	blockDone := make(chan struct{})
+	c := &httpgzip.Config{
+		Adaptive: &httpgzip.AdaptiveLevel{
+			MaxInFlight:   1,
+			AllowIdentity: true,
+		},
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				if r.URL.Path == "/block" {
+					close(blockDone)
+					return
+				}
+				statsc <- s
+			}),
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, 3, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gzh)
+	defer ts.Close()
+	get := func(path string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := (&http.Transport{}).RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		get("/block")
+		close(done)
+	}()
+	<-started
+	for _, expected := range []struct {
+		coding string
+		level  int
+	}{
+		{"gzip", 2},
+		{"gzip", 1},
+		{"identity", 0},
+		{"identity", 0},
+	} {
+		get("/")
+		s := <-statsc
+		if s.Coding != expected.coding ||
+			s.Coding == "gzip" && s.Level != expected.level {
+			t.Fatalf(
+				"\nexpected %s level %d, got stats %+v\n",
+				expected.coding, expected.level, s)
+		}
+	}
+	close(unblock)
+	<-done
+	<-blockDone
+	for _, level := range []int{1, 2, 3, 3} {
+		get("/")
+		s := <-statsc
+		if s.Coding != "gzip" || s.Level != level {
+			t.Fatalf("\nexpected gzip level %d, got stats %+v\n", level, s)
+		}
+	}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp,
+		&httpgzip.Config{
+			Adaptive: &httpgzip.AdaptiveLevel{MaxInFlight: -1},
+		}); err == nil {
+		t.Fatalf("\nexpected error for negative limit\n")
+	}
+}
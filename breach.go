@@ -0,0 +1,135 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/xi2/httpgzip/internal/gzip"
+	"github.com/xi2/httpgzip/internal/pgzip"
+)
+
+// A BreachMitigation configures mitigations against the BREACH attack,
+// which recovers secrets such as CSRF tokens from compressed responses
+// which also reflect input controlled by an attacker, by observing the
+// responses' lengths. It is used by setting the Breach field of a
+// Config.
+//
+// Random padding makes the attack slower, since more requests are
+// needed to average out the noise it adds to the length, but does not
+// prevent it. Not compressing responses which set cookies, or which
+// answer requests made by other sites, does prevent it for those
+// responses.
+type BreachMitigation struct {
+	// Padding, if positive, makes the handler pad each compressed
+	// response with a random number of bytes between 0 and Padding
+	// inclusive. The padding is a comment in the gzip header, or, if
+	// HTMLPadding is true and the response is HTML, an HTML comment
+	// at the end of the response, in which case a strong ETag
+	// header is made weak, since the response's bytes vary.
+	// Responses using the gzip transfer coding are always padded in
+	// the gzip header, since their content, which may be a byte
+	// range, must not change. Other content codings, such as those
+	// of dictionaries, have no header in which to pad, so responses
+	// using them are only padded as HTML, and otherwise have the
+	// Unpadded field of their Stats set.
+	Padding     int
+	HTMLPadding bool
+	// SkipSetCookie, if true, makes the handler not compress
+	// responses with a Set-Cookie header.
+	SkipSetCookie bool
+	// SkipCrossSite, if true, makes the handler not compress
+	// responses to requests whose Sec-Fetch-Site header is
+	// "cross-site".
+	SkipCrossSite bool
+}
+
+// validate returns an error if b has invalid settings.
+func (b *BreachMitigation) validate() error {
+	if b.Padding < 0 || b.Padding > 0xffff {
+		return fmt.Errorf(
+			"httpgzip: invalid BREACH mitigation padding: %d", b.Padding)
+	}
+	return nil
+}
+
+// skip reports whether compression of a response with the header h
+// to the request r should be skipped.
+func (b *BreachMitigation) skip(h http.Header, r *http.Request) bool {
+	return b.SkipSetCookie && h.Get("Set-Cookie") != "" ||
+		b.SkipCrossSite && r.Header.Get("Sec-Fetch-Site") == "cross-site"
+}
+
+// padding returns a string of random lower case letters whose length
+// is between 0 and b.Padding inclusive.
+func (b *BreachMitigation) padding() string {
+	var n [4]byte
+	_, _ = rand.Read(n[:])
+	p := make([]byte, binary.LittleEndian.Uint32(n[:])%uint32(b.Padding+1))
+	_, _ = rand.Read(p)
+	for i := range p {
+		p[i] = 'a' + p[i]%26
+	}
+	return string(p)
+}
+
+// pad gets called by init once w.gw has been set to add padding to
+// the response, if w.breach asks for it, either by setting padHTML or
+// by adding to the comment in h, the gzip header to be written. If
+// w.gw writes no gzip header it sets unpadded instead. isHTML is
+// whether the response is HTML.
+func (w *gzipResponseWriter) pad(isHTML bool, h *gzip.Header) {
+	if w.breach == nil || w.breach.Padding <= 0 {
+		return
+	}
+	if w.breach.HTMLPadding && isHTML && !w.te {
+		// written by closeGzip
+		w.padHTML = true
+		if etag := w.Header().Get("ETag"); strings.HasPrefix(etag, `"`) {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+		return
+	}
+	switch w.gw.(type) {
+	case *gzip.Writer, *pgzip.Writer:
+		// padded in the gzip header
+	default:
+		w.unpadded = true
+		return
+	}
+	if h.Comment != "" {
+		h.Comment += " "
+	}
+	h.Comment += w.breach.padding()
+}
+
+// setGzipHeader sets the gzip header written by w.gw.
+func (w *gzipResponseWriter) setGzipHeader(h gzip.Header) {
+	switch gw := w.gw.(type) {
+	case *gzip.Writer:
+		gw.SetHeader(h)
+	case *pgzip.Writer:
+		gw.Header = pgzip.Header(h)
+	}
+}
+
+// writeHTMLPadding gets called by closeGzip to write the HTML comment
+// padding the response, if pad decided to use one.
+func (w *gzipResponseWriter) writeHTMLPadding() error {
+	if !w.padHTML {
+		return nil
+	}
+	p := []byte("<!-- " + w.breach.padding() + " -->")
+	// the padding is part of the response the client receives, and
+	// so of any dictionary it stores
+	w.teeDictionary(p)
+	w.hashUncompressed(p)
+	_, err := w.output(p)
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestBreachPadding checks that compressed responses are padded with
+// a gzip header comment, or with an HTML comment for HTML responses,
+// of varying length, that the ETag of responses padded with an HTML
+// comment is weak, and that responses using a preset dictionary,
+// which cannot be padded, are reported as unpadded.
+func TestBreachPadding(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(data)
+	})
+	for _, parallel := range []int64{0, 1024} {
+		c := &httpgzip.Config{
+			Breach: &httpgzip.BreachMitigation{
+				Padding:     64,
+				HTMLPadding: true,
+			},
+			ParallelThreshold: parallel,
+		}
+		htmlComment := regexp.MustCompile(`^<!-- [a-z]{0,64} -->$`)
+		headerLens := map[int]bool{}
+		htmlLens := map[int]bool{}
+		for i := 0; i < 20; i++ {
+			_, body := getPathConfig(t, h, defComp, c, "/?ct=text/plain",
+				[]string{"Accept-Encoding: gzip"})
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("\nbody differs (err %v)\n", err)
+			}
+			if len(zr.Comment) > 64 {
+				t.Fatalf("\ncomment too long: %q\n", zr.Comment)
+			}
+			headerLens[len(zr.Comment)] = true
+			res, body := getPathConfig(t, h, defComp, c, "/?ct=text/html",
+				[]string{"Accept-Encoding: gzip"})
+			if etag := res.Header.Get("ETag"); etag != `W/"v1"` {
+				t.Fatalf("\nunexpected ETag %q\n", etag)
+			}
+			zr, err = gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = ioutil.ReadAll(zr)
+			if err != nil || !bytes.HasPrefix(got, data) {
+				t.Fatalf("\nbody differs (err %v)\n", err)
+			}
+			if zr.Comment != "" ||
+				!htmlComment.Match(got[len(data):]) {
+				t.Fatalf("\nunexpected padding %q, %q\n",
+					zr.Comment, got[len(data):])
+			}
+			htmlLens[len(got)] = true
+		}
+		if len(headerLens) < 2 || len(htmlLens) < 2 {
+			t.Fatalf("\nexpected padding of varying length\n")
+		}
+	}
+	unpadded := make(chan bool, 1)
+	c := &httpgzip.Config{
+		Breach: &httpgzip.BreachMitigation{Padding: 64},
+		Preset: &httpgzip.PresetDictionary{
+			Coding: "x-deflate-dict",
+			Dict:   data,
+		},
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				unpadded <- s.Unpadded
+			}),
+	}
+	for _, tc := range []struct {
+		accept   string
+		coding   string
+		unpadded bool
+	}{
+		{"gzip", "gzip", false},
+		{"gzip, x-deflate-dict", "x-deflate-dict", true},
+	} {
+		res, _ := getPathConfig(t, h, defComp, c, "/?ct=text/plain",
+			[]string{"Accept-Encoding: " + tc.accept})
+		if ce := res.Header.Get("Content-Encoding"); ce != tc.coding {
+			t.Fatalf("\nexpected Content-Encoding %s, got %s\n",
+				tc.coding, ce)
+		}
+		if u := <-unpadded; u != tc.unpadded {
+			t.Fatalf("\ncoding %s, expected unpadded %v, got %v\n",
+				tc.coding, tc.unpadded, u)
+		}
+	}
+	c = &httpgzip.Config{Breach: &httpgzip.BreachMitigation{Padding: -1}}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for invalid padding\n")
+	}
+}
+
+// TestBreachSkip checks that responses setting cookies, and responses
+// to cross-site requests, are not compressed unless the request only
+// accepts gzip.
+func TestBreachSkip(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cookie" {
+			w.Header().Set("Set-Cookie", "a=b")
+		}
+		_, _ = w.Write(data)
+	})
+	skipc := make(chan httpgzip.SkipReason, 1)
+	c := &httpgzip.Config{
+		Breach: &httpgzip.BreachMitigation{
+			SkipSetCookie: true,
+			SkipCrossSite: true,
+		},
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				skipc <- s.Skip
+			}),
+	}
+	for _, tc := range []struct {
+		path    string
+		headers []string
+		skip    httpgzip.SkipReason
+	}{
+		{"/", []string{"Accept-Encoding: gzip"}, httpgzip.NotSkipped},
+		{"/cookie", []string{"Accept-Encoding: gzip, identity"},
+			httpgzip.SkipBreach},
+		{"/", []string{"Accept-Encoding: gzip",
+			"Sec-Fetch-Site: cross-site"}, httpgzip.SkipBreach},
+		{"/", []string{"Accept-Encoding: gzip",
+			"Sec-Fetch-Site: same-origin"}, httpgzip.NotSkipped},
+		{"/cookie", []string{"Accept-Encoding: gzip, identity;q=0"},
+			httpgzip.NotSkipped},
+	} {
+		res, _ := getPathConfig(t, h, defComp, c, tc.path, tc.headers)
+		if skip := <-skipc; skip != tc.skip {
+			t.Fatalf("\npath %s, headers %v\nexpected skip %v, got %v\n",
+				tc.path, tc.headers, tc.skip, skip)
+		}
+		gzipped := res.Header.Get("Content-Encoding") == "gzip"
+		if gzipped != (tc.skip == httpgzip.NotSkipped) {
+			t.Fatalf("\npath %s, headers %v\nunexpected Content-Encoding %q\n",
+				tc.path, tc.headers, res.Header.Get("Content-Encoding"))
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestBufferLimit requests responses written in several parts from a
+// handler whose Config has BufferLimit 4096, and checks that those
+// whose compressed size is within the limit are sent with a
+// Content-Length header and header fields which would otherwise be
+// trailers, and those exceeding it are streamed.
+func TestBufferLimit(t *testing.T) {
+	text, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 48*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	bodies := map[string][]byte{
+		"/small": bytes.Repeat(text, 4),
+		"/large": []byte(base64.StdEncoding.EncodeToString(random)),
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		b := bodies[r.URL.Path]
+		for len(b) > 0 {
+			n := len(b)
+			if n > 4096 {
+				n = 4096
+			}
+			_, _ = w.Write(b[:n])
+			b = b[n:]
+		}
+	})
+	c := &httpgzip.Config{
+		BufferLimit:  4096,
+		ServerTiming: true,
+		Digests:      &httpgzip.Digests{Content: true, Repr: true},
+	}
+	for _, tc := range []struct {
+		path string
+		held bool
+	}{
+		{"/small", true},
+		{"/large", false},
+	} {
+		res, body := getPathConfig(t, h, defComp, c, tc.path,
+			[]string{"Accept-Encoding: gzip"})
+		if !isGzip(body) {
+			t.Fatalf("\npath %s, expected gzipped body\n", tc.path)
+		}
+		if !bytes.Equal(gunzip(t, body), bodies[tc.path]) {
+			t.Fatalf("\npath %s, body differs\n", tc.path)
+		}
+		header := res.Header
+		if !tc.held {
+			header = res.Trailer
+		}
+		for _, k := range []string{
+			"Server-Timing", "Content-Digest", "Repr-Digest",
+		} {
+			if header.Get(k) == "" {
+				t.Fatalf("\npath %s, expected %s held %v\n",
+					tc.path, k, tc.held)
+			}
+		}
+		if v := header.Get("Content-Digest"); v != sha256Digest(body) {
+			t.Fatalf("\npath %s, unexpected Content-Digest %q\n",
+				tc.path, v)
+		}
+		cl := res.Header.Get("Content-Length")
+		if tc.held && cl != strconv.Itoa(len(body)) ||
+			!tc.held && (cl != "" || res.ContentLength != -1) {
+			t.Fatalf("\npath %s, body length %d, "+
+				"unexpected Content-Length %q\n",
+				tc.path, len(body), cl)
+		}
+	}
+	c = &httpgzip.Config{BufferLimit: -1}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for negative buffer limit\n")
+	}
+}
+
+// TestBufferLimitHead requests a file from an http.FileServer using
+// HEAD and GET requests which only accept gzip encoding, and checks
+// that whether or not BufferLimit is set, the response to the HEAD
+// request has no Content-Length header, and the response to the GET
+// request has one only if BufferLimit is set.
+func TestBufferLimitHead(t *testing.T) {
+	for _, limit := range []int64{0, 4096} {
+		c := &httpgzip.Config{BufferLimit: limit}
+		gzh, err := httpgzip.NewHandlerConfig(
+			http.FileServer(http.Dir("testdata")), nil, defComp, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(gzh)
+		for _, method := range []string{"HEAD", "GET"} {
+			req, _ := http.NewRequest(method, ts.URL+"/4096bytes.txt", nil)
+			req.Header.Set("Accept-Encoding", "gzip, identity;q=0")
+			client := http.Client{
+				Transport: &http.Transport{DisableCompression: true},
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl := res.Header.Get("Content-Length")
+			want := ""
+			if method == "GET" && limit > 0 {
+				want = strconv.Itoa(len(body))
+			}
+			if cl != want {
+				t.Fatalf("\nbuffer limit %d, method %s, body length %d, "+
+					"unexpected Content-Length %q\n",
+					limit, method, len(body), cl)
+			}
+		}
+		ts.Close()
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Names of the debug headers described in the package documentation.
+const (
+	decisionHeader       = "X-Httpgzip-Decision"
+	originalSizeHeader   = "X-Httpgzip-Original-Size"
+	compressedSizeHeader = "X-Httpgzip-Compressed-Size"
+)
+
+// debug returns whether debug headers should be added to the
+// response to the request r.
+func (c *Config) debug(r *http.Request) bool {
+	return c.Debug || c.DebugHeader != "" && r.Header.Get(c.DebugHeader) != ""
+}
+
+// setDebugHeaders gets called by init once it has made its
+// decision. It sets the decision header and, if the response is not
+// being compressed and its size is known because it has been wholly
+// buffered or has a Content-Length header, the size headers.
+func (w *gzipResponseWriter) setDebugHeaders() {
+	var decision string
+	switch w.skip {
+	case NotSkipped:
+		level := strconv.Itoa(w.level)
+		if w.level == DefaultCompression {
+			level = "default"
+		}
+		decision = "gzip; level=" + level
+		switch {
+		case w.te:
+			decision += "; transfer-coding"
+		case w.coding != "gzip":
+			decision = w.coding + "; dictionary"
+		}
+	case SkipPresetEncoding:
+		decision = w.Header().Get("Content-Encoding") +
+			"; reason=" + w.skip.String()
+	default:
+		decision = "identity; reason=" + w.skip.String()
+	}
+	w.Header().Set(decisionHeader, decision)
+	if w.skip == NotSkipped {
+		return
+	}
+	size := w.Header().Get("Content-Length")
+	if w.closing {
+		size = strconv.Itoa(w.buf.Len())
+	}
+	if size != "" {
+		w.Header().Set(originalSizeHeader, size)
+		w.Header().Set(compressedSizeHeader, size)
+	}
+}
+
+// setDebugTrailers gets called by Close once the response has been
+// written. It sends any size headers not set by setDebugHeaders as
+// trailers.
+func (w *gzipResponseWriter) setDebugTrailers() {
+	if w.Header().Get(originalSizeHeader) != "" {
+		return
+	}
+	w.Header().Set(http.TrailerPrefix+originalSizeHeader,
+		strconv.FormatInt(w.n, 10))
+	w.Header().Set(http.TrailerPrefix+compressedSizeHeader,
+		strconv.FormatInt(w.cw.n, 10))
+}
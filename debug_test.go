@@ -0,0 +1,69 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestDebugHeaders requests files from an http.FileServer wrapped
+// with Configs enabling debug headers, and checks the headers and
+// trailers of the responses.
+func TestDebugHeaders(t *testing.T) {
+	fs := http.FileServer(http.Dir("testdata"))
+	debug := &httpgzip.Config{Debug: true}
+	debugHeader := &httpgzip.Config{DebugHeader: "X-Debug"}
+	for _, tc := range []struct {
+		c          *httpgzip.Config
+		path       string
+		reqHeaders []string
+		decision   string
+		trailers   bool
+	}{
+		{debug, "/4096bytes.txt", []string{"Accept-Encoding: gzip"},
+			"gzip; level=1", true},
+		{debug, "/511bytes.txt", []string{"Accept-Encoding: gzip"},
+			"identity; reason=too-small", false},
+		{debug, "/4096bytes.bin", nil,
+			"identity; reason=client-refused", false},
+		{debug, "/4096bytes.txt", []string{"Accept-Encoding: *;q=0"},
+			"none; reason=not-acceptable", false},
+		{debugHeader, "/4096bytes.txt", []string{"Accept-Encoding: gzip"},
+			"", false},
+		{debugHeader, "/4096bytes.txt",
+			[]string{"Accept-Encoding: gzip", "X-Debug: 1"},
+			"gzip; level=1", true},
+	} {
+		res, body := getPathConfig(
+			t, fs, httpgzip.BestSpeed, tc.c, tc.path, tc.reqHeaders)
+		if res.Header.Get("X-Httpgzip-Decision") != tc.decision {
+			t.Fatalf(
+				"\nfile %s, request headers %v\n"+
+					"expected decision %q, got %q\n",
+				tc.path, tc.reqHeaders,
+				tc.decision, res.Header.Get("X-Httpgzip-Decision"))
+		}
+		if tc.decision == "" || res.StatusCode != http.StatusOK {
+			continue
+		}
+		sizes := res.Header
+		if tc.trailers {
+			sizes = res.Trailer
+		}
+		original := sizes.Get("X-Httpgzip-Original-Size")
+		compressed := sizes.Get("X-Httpgzip-Compressed-Size")
+		if compressed != strconv.Itoa(len(body)) || original == "" ||
+			tc.decision[:4] != "gzip" && original != compressed {
+			t.Fatalf(
+				"\nfile %s, request headers %v\n"+
+					"unexpected sizes %s, %s for body of length %d\n",
+				tc.path, tc.reqHeaders, original, compressed, len(body))
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A DictionaryTransport configures Compression Dictionary Transport
+// (RFC 9842), which compresses responses using an earlier response
+// the client has stored as a dictionary. This greatly reduces the size
+// of resources, such as JavaScript bundles, which change little from
+// one version to the next. It is used by setting the Dictionaries
+// field of a Config.
+//
+// Responses to requests for which Advertise returns a non-empty string
+// are sent with a Use-As-Dictionary header having that value, for
+// example `match="/js/app.*.js"`, and their bodies are added to
+// Store. A later request matching the pattern carries an
+// Available-Dictionary header giving the SHA-256 hash of the stored
+// response. If Store has a dictionary with that hash, and the request
+// accepts the content coding of one of Encoders, a response which
+// would have been gzip compressed is instead compressed by that
+// encoder against the dictionary. Otherwise gzip compression is used
+// as usual.
+type DictionaryTransport struct {
+	// Store holds the dictionaries. It must not be nil.
+	Store DictionaryStore
+	// Encoders are the dictionary compressors in order of
+	// preference.
+	Encoders []DictionaryEncoder
+	// Advertise, if not nil, returns the value of the
+	// Use-As-Dictionary header to send with the response to r, or
+	// the empty string to send none.
+	Advertise func(r *http.Request) string
+	// MaxSize, if positive, is the size of the largest response
+	// added to Store. It defaults to 16MB.
+	MaxSize int64
+}
+
+// A DictionaryStore holds dictionaries, which are the uncompressed
+// bodies of earlier responses, by their SHA-256 hash. Its methods may
+// be called concurrently.
+type DictionaryStore interface {
+	// Dictionary returns the dictionary with the given hash.
+	Dictionary(hash [sha256.Size]byte) ([]byte, bool)
+	// Add adds dict to the store. It must not modify dict.
+	Add(dict []byte)
+}
+
+// A DictionaryEncoder compresses responses using a dictionary. Since
+// the standard library implements neither Brotli nor Zstandard, no
+// DictionaryEncoders are provided by this package, but they are
+// easily written using third party packages.
+type DictionaryEncoder interface {
+	// Coding returns the content coding of the encoder: "dcb" for
+	// Brotli or "dcz" for Zstandard.
+	Coding() string
+	// NewWriter returns an io.WriteCloser compressing data written
+	// to it to w, using dict as a raw (not prefixed) dictionary. Its
+	// output is the Brotli stream or Zstandard frame, without the
+	// header giving the dictionary's hash, which is written by the
+	// caller. Close must not close w.
+	NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error)
+}
+
+// dictionaryMagic holds the magic numbers which start responses using
+// each dictionary content coding, before the dictionary's hash.
+var dictionaryMagic = map[string][]byte{
+	"dcb": {0xff, 0x44, 0x43, 0x42},
+	"dcz": {0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00},
+}
+
+// defaultMaxDictionarySize is the default value of a
+// DictionaryTransport's MaxSize.
+const defaultMaxDictionarySize = 16 << 20
+
+// validate returns an error if d has invalid settings.
+func (d *DictionaryTransport) validate() error {
+	if d.Store == nil {
+		return fmt.Errorf("httpgzip: nil dictionary store")
+	}
+	for _, e := range d.Encoders {
+		if _, ok := dictionaryMagic[e.Coding()]; !ok {
+			return fmt.Errorf(
+				"httpgzip: invalid dictionary content coding: %s",
+				e.Coding())
+		}
+	}
+	return nil
+}
+
+// maxSize returns the size of the largest response added to d.Store.
+func (d *DictionaryTransport) maxSize() int64 {
+	if d.MaxSize > 0 {
+		return d.MaxSize
+	}
+	return defaultMaxDictionarySize
+}
+
+// parseAvailableDictionary parses the value of an Available-Dictionary
+// header, which is a structured field byte sequence holding a SHA-256
+// hash.
+func parseAvailableDictionary(h string) (hash [sha256.Size]byte, ok bool) {
+	h = strings.TrimSpace(h)
+	if len(h) < 2 || h[0] != ':' || h[len(h)-1] != ':' {
+		return hash, false
+	}
+	b, err := base64.StdEncoding.DecodeString(h[1 : len(h)-1])
+	if err != nil || len(b) != sha256.Size {
+		return hash, false
+	}
+	copy(hash[:], b)
+	return hash, true
+}
+
+// chooseDictionary gets called by init when it has decided to compress
+// the response. If the request has an Available-Dictionary header
+// naming a stored dictionary, and accepts the content coding of one of
+// w.dicts.Encoders, it returns a dictWriter using them.
+func (w *gzipResponseWriter) chooseDictionary() *dictWriter {
+	hash, ok := parseAvailableDictionary(
+		w.req.Header.Get("Available-Dictionary"))
+	if !ok {
+		return nil
+	}
+	qs := parseAcceptEncoding(w.req.Header.Get("Accept-Encoding"))
+	for _, e := range w.dicts.Encoders {
+		if q, ok := qs[e.Coding()]; !ok || q == 0 {
+			continue
+		}
+		dict, ok := w.dicts.Store.Dictionary(hash)
+		if !ok {
+			return nil
+		}
+		prefix := append([]byte(nil), dictionaryMagic[e.Coding()]...)
+		return &dictWriter{
+			w:      &w.cw,
+			prefix: append(prefix, hash[:]...),
+			enc:    e,
+			dict:   dict,
+		}
+	}
+	return nil
+}
+
+// A dictWriter is a compressor which writes a response compressed by
+// a DictionaryEncoder. The hash of the dictionary is written, and the
+// encoder created, on the first call to Write or Close, so that
+// nothing is written to w before the response's header.
+type dictWriter struct {
+	w      io.Writer
+	prefix []byte // magic number and dictionary hash
+	enc    DictionaryEncoder
+	dict   []byte
+	zw     io.WriteCloser
+}
+
+// start writes dw.prefix and creates the encoder.
+func (dw *dictWriter) start() error {
+	if _, err := dw.w.Write(dw.prefix); err != nil {
+		return err
+	}
+	zw, err := dw.enc.NewWriter(dw.w, dw.dict)
+	if err != nil {
+		return err
+	}
+	dw.zw = zw
+	return nil
+}
+
+func (dw *dictWriter) Write(p []byte) (int, error) {
+	if dw.zw == nil {
+		if err := dw.start(); err != nil {
+			return 0, err
+		}
+	}
+	return dw.zw.Write(p)
+}
+
+func (dw *dictWriter) Close() error {
+	if dw.zw == nil {
+		if err := dw.start(); err != nil {
+			return err
+		}
+	}
+	return dw.zw.Close()
+}
+
+// Reset is a no-op, since dictWriters are not pooled.
+func (dw *dictWriter) Reset(w io.Writer) {}
+
+// teeDictionary gets called by write, and by writeHTMLPadding, to keep
+// a copy of the response the client receives when it is to be added
+// to w.dicts.Store.
+func (w *gzipResponseWriter) teeDictionary(p []byte) {
+	if w.dictBuf == nil {
+		return
+	}
+	if int64(w.dictBuf.Len()+len(p)) > w.dicts.maxSize() {
+		w.dictBuf = nil
+		return
+	}
+	_, _ = w.dictBuf.Write(p)
+}
+
+// storeDictionary gets called by Close to add the response to
+// w.dicts.Store if it was advertised as a dictionary. The response to
+// a HEAD request is not added, since its body is not sent.
+func (w *gzipResponseWriter) storeDictionary() {
+	if w.dictBuf == nil || w.httpStatus != http.StatusOK ||
+		w.skip == SkipPresetEncoding || w.req.Method == "HEAD" {
+		return
+	}
+	w.dicts.Store.Add(w.dictBuf.Bytes())
+	w.dictBuf = nil
+}
+
+// A MemoryDictionaryStore is a DictionaryStore which holds
+// dictionaries in memory. If MaxBytes is positive, the oldest
+// dictionaries are removed so that the total size of the dictionaries
+// is at most MaxBytes. The zero value is an empty store with no limit.
+type MemoryDictionaryStore struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	dicts map[[sha256.Size]byte][]byte
+	order [][sha256.Size]byte // hashes, oldest first
+	size  int64
+}
+
+// Dictionary implements the DictionaryStore interface.
+func (s *MemoryDictionaryStore) Dictionary(hash [sha256.Size]byte) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dict, ok := s.dicts[hash]
+	return dict, ok
+}
+
+// Add implements the DictionaryStore interface.
+func (s *MemoryDictionaryStore) Add(dict []byte) {
+	if s.MaxBytes > 0 && int64(len(dict)) > s.MaxBytes {
+		return
+	}
+	hash := sha256.Sum256(dict)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dicts[hash]; ok {
+		return
+	}
+	if s.dicts == nil {
+		s.dicts = map[[sha256.Size]byte][]byte{}
+	}
+	s.dicts[hash] = bytes.Clone(dict)
+	s.order = append(s.order, hash)
+	s.size += int64(len(dict))
+	for s.MaxBytes > 0 && s.size > s.MaxBytes {
+		s.size -= int64(len(s.dicts[s.order[0]]))
+		delete(s.dicts, s.order[0])
+		s.order = s.order[1:]
+	}
+}
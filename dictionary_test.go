@@ -0,0 +1,207 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// testEncoder is a DictionaryEncoder which, instead of compressing,
+// writes the length of the dictionary followed by the data written
+// to it.
+type testEncoder string
+
+func (e testEncoder) Coding() string { return string(e) }
+
+func (e testEncoder) NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error) {
+	if _, err := fmt.Fprintf(w, "%d:", len(dict)); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestDictionaryTransport requests a resource advertised as a
+// dictionary, and then requests it again with various
+// Available-Dictionary and Accept-Encoding headers.
+func TestDictionaryTransport(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	})
+	store := &httpgzip.MemoryDictionaryStore{}
+	c := &httpgzip.Config{
+		Dictionaries: &httpgzip.DictionaryTransport{
+			Store:    store,
+			Encoders: []httpgzip.DictionaryEncoder{testEncoder("dcz")},
+			Advertise: func(r *http.Request) string {
+				if r.URL.Path == "/app.js" {
+					return `match="/app.js"`
+				}
+				return ""
+			},
+		},
+	}
+	res, body := getPathConfig(t, h, defComp, c, "/app.js",
+		[]string{"Accept-Encoding: gzip, dcz"})
+	if v := res.Header.Get("Use-As-Dictionary"); v != `match="/app.js"` {
+		t.Fatalf("\nunexpected Use-As-Dictionary header %q\n", v)
+	}
+	if !isGzip(body) {
+		t.Fatalf("\nexpected gzipped body\n")
+	}
+	hash := sha256.Sum256(data)
+	if dict, ok := store.Dictionary(hash); !ok || !bytes.Equal(dict, data) {
+		t.Fatalf("\nexpected response to be stored as a dictionary\n")
+	}
+	available := "Available-Dictionary: :" +
+		base64.StdEncoding.EncodeToString(hash[:]) + ":"
+	other := sha256.Sum256([]byte("other"))
+	for _, tc := range []struct {
+		headers []string
+		coding  string
+	}{
+		{[]string{"Accept-Encoding: gzip, dcz", available}, "dcz"},
+		{[]string{"Accept-Encoding: gzip, dcb", available}, "gzip"},
+		{[]string{"Accept-Encoding: gzip, dcz;q=0", available}, "gzip"},
+		{[]string{"Accept-Encoding: gzip, dcz"}, "gzip"},
+		{[]string{"Accept-Encoding: gzip, dcz", "Available-Dictionary: :" +
+			base64.StdEncoding.EncodeToString(other[:]) + ":"}, "gzip"},
+		{[]string{"Accept-Encoding: gzip, dcz",
+			"Available-Dictionary: nonsense"}, "gzip"},
+	} {
+		res, body := getPathConfig(t, h, defComp, c, "/other", tc.headers)
+		if ce := res.Header.Get("Content-Encoding"); ce != tc.coding {
+			t.Fatalf("\nheaders %v\nexpected Content-Encoding %s, got %s\n",
+				tc.headers, tc.coding, ce)
+		}
+		vary := strings.Join(res.Header.Values("Vary"), ", ")
+		if vary != "Accept-Encoding, Available-Dictionary" {
+			t.Fatalf("\nheaders %v\nunexpected Vary header %q\n",
+				tc.headers, vary)
+		}
+		if tc.coding != "dcz" {
+			continue
+		}
+		var expected []byte
+		expected = append(expected,
+			0x5e, 0x2a, 0x4d, 0x18, 0x20, 0x00, 0x00, 0x00)
+		expected = append(expected, hash[:]...)
+		expected = append(expected, fmt.Sprintf("%d:", len(data))...)
+		expected = append(expected, data...)
+		if !bytes.Equal(body, expected) {
+			t.Fatalf("\nheaders %v\nunexpected body\n", tc.headers)
+		}
+	}
+	c = &httpgzip.Config{Dictionaries: &httpgzip.DictionaryTransport{
+		Store:    store,
+		Encoders: []httpgzip.DictionaryEncoder{testEncoder("br")},
+	}}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for invalid coding\n")
+	}
+	c = &httpgzip.Config{Dictionaries: &httpgzip.DictionaryTransport{}}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for nil store\n")
+	}
+}
+
+// TestDictionaryTransportPadding requests an HTML resource advertised
+// as a dictionary from a handler which pads HTML responses, and checks
+// that the dictionary stored is the padded response the client
+// receives. It also checks that the response to a HEAD request is not
+// stored.
+func TestDictionaryTransportPadding(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.Method != "HEAD" {
+			_, _ = w.Write(data)
+		}
+	})
+	store := &httpgzip.MemoryDictionaryStore{}
+	c := &httpgzip.Config{
+		Breach: &httpgzip.BreachMitigation{
+			Padding:     64,
+			HTMLPadding: true,
+		},
+		Dictionaries: &httpgzip.DictionaryTransport{
+			Store: store,
+			Advertise: func(r *http.Request) string {
+				return `match="/*"`
+			},
+		},
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("HEAD", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzh.ServeHTTP(httptest.NewRecorder(), req)
+	if _, ok := store.Dictionary(sha256.Sum256(nil)); ok {
+		t.Fatalf("\nexpected response to HEAD request not to be stored\n")
+	}
+	_, body := getPathConfig(t, h, defComp, c, "/",
+		[]string{"Accept-Encoding: gzip"})
+	received := gunzip(t, body)
+	if !bytes.HasPrefix(received, data) || len(received) == len(data) {
+		t.Fatalf("\nexpected padded body\n")
+	}
+	if _, ok := store.Dictionary(sha256.Sum256(received)); !ok {
+		t.Fatalf("\nexpected padded response to be stored as a dictionary\n")
+	}
+}
+
+// TestMemoryDictionaryStore checks that a MemoryDictionaryStore
+// removes its oldest dictionaries when its MaxBytes is exceeded.
+func TestMemoryDictionaryStore(t *testing.T) {
+	s := &httpgzip.MemoryDictionaryStore{MaxBytes: 10}
+	a, b, c := []byte("aaaa"), []byte("bbbb"), []byte("cccc")
+	s.Add(a)
+	s.Add(b)
+	s.Add(a)
+	s.Add(c)
+	s.Add([]byte("too large to store"))
+	for _, tc := range []struct {
+		dict   []byte
+		stored bool
+	}{
+		{a, false},
+		{b, true},
+		{c, true},
+		{[]byte("too large to store"), false},
+	} {
+		if _, ok := s.Dictionary(sha256.Sum256(tc.dict)); ok != tc.stored {
+			t.Fatalf("\ndictionary %q, expected stored %v\n",
+				tc.dict, tc.stored)
+		}
+	}
+}
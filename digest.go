@@ -0,0 +1,179 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A Digests configures the integrity digests of RFC 9530. It is used
+// by setting the Digests field of a Config.
+//
+// The Content-Digest field is a digest of the bytes of the response
+// as sent, after any content coding such as gzip compression, but
+// before the gzip transfer coding. The Repr-Digest field is a digest
+// of the representation, which also includes any content coding, so
+// for a complete response it is computed over the same bytes as
+// Content-Digest. It is not sent for partial content responses, whose
+// content is only part of the representation. The fields are sent as
+// headers if the whole response was buffered before the response
+// headers were written, and as trailers otherwise. Trailers cannot be
+// sent with responses which have a Content-Length header, such as
+// uncompressed responses from http.FileServer.
+type Digests struct {
+	// Content and Repr enable the Content-Digest and Repr-Digest
+	// fields.
+	Content bool
+	Repr    bool
+	// Algorithms are the hash algorithms which may be used, in
+	// order of preference: "sha-256" and "sha-512". If empty,
+	// sha-256 is used. The algorithm used for each field is the one
+	// the request's Want-Content-Digest or Want-Repr-Digest header
+	// gives the highest preference, and the first of Algorithms if
+	// there is no such header.
+	Algorithms []string
+	// OnlyWanted, if true, makes the handler only send each field
+	// if the request has the corresponding Want- header.
+	OnlyWanted bool
+}
+
+// digestAlgorithms holds the supported hash algorithms.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// validate returns an error if d has invalid settings.
+func (d *Digests) validate() error {
+	for _, a := range d.Algorithms {
+		if _, ok := digestAlgorithms[a]; !ok {
+			return fmt.Errorf("httpgzip: unsupported digest algorithm: %s", a)
+		}
+	}
+	return nil
+}
+
+// algorithm returns the hash algorithm to use for a field given the
+// value of the corresponding Want- request header, or the empty string
+// if the field should not be sent.
+//
+// ref: https://www.rfc-editor.org/rfc/rfc9530#section-4
+func (d *Digests) algorithm(want string) string {
+	algs := d.Algorithms
+	if len(algs) == 0 {
+		algs = []string{"sha-256"}
+	}
+	if want == "" {
+		if d.OnlyWanted {
+			return ""
+		}
+		return algs[0]
+	}
+	prefs := map[string]int{}
+	for _, s := range strings.Split(want, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(s), "=")
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			prefs[strings.ToLower(strings.TrimSpace(k))] = n
+		}
+	}
+	var best string
+	var bestPref int
+	for _, a := range algs {
+		if p := prefs[a]; p > bestPref {
+			best, bestPref = a, p
+		}
+	}
+	return best
+}
+
+// A digester computes the digests of a response.
+type digester struct {
+	content, repr       hash.Hash // nil if the field is not sent
+	contentAlg, reprAlg string
+	sent                bool // whether the fields have been set
+}
+
+// newDigester returns a digester for the response to r, or nil if no
+// digests are to be sent.
+func newDigester(d *Digests, r *http.Request) *digester {
+	if r.Method == "HEAD" {
+		return nil
+	}
+	dg := &digester{}
+	if d.Content {
+		dg.contentAlg = d.algorithm(r.Header.Get("Want-Content-Digest"))
+		if dg.contentAlg != "" {
+			dg.content = digestAlgorithms[dg.contentAlg]()
+		}
+	}
+	if d.Repr {
+		dg.reprAlg = d.algorithm(r.Header.Get("Want-Repr-Digest"))
+		if dg.reprAlg != "" {
+			dg.repr = digestAlgorithms[dg.reprAlg]()
+		}
+	}
+	if dg.content == nil && dg.repr == nil {
+		return nil
+	}
+	return dg
+}
+
+// digestValue returns the value of a digest field using the
+// algorithm alg and the hash h.
+func digestValue(alg string, h hash.Hash) string {
+	return alg + "=:" + base64.StdEncoding.EncodeToString(h.Sum(nil)) + ":"
+}
+
+// writer returns an io.Writer writing to each of dg's hashes.
+func (dg *digester) writer() io.Writer {
+	switch {
+	case dg.content == nil:
+		return dg.repr
+	case dg.repr == nil:
+		return dg.content
+	}
+	return io.MultiWriter(dg.content, dg.repr)
+}
+
+// hashUncompressed gets called with the uncompressed bytes of the
+// response as they are written. Only if the gzip transfer coding is in
+// use are they the content and representation, which are otherwise
+// hashed by cw as they are sent.
+func (w *gzipResponseWriter) hashUncompressed(p []byte) {
+	if w.digest == nil || !w.te {
+		return
+	}
+	_, _ = w.digest.writer().Write(p)
+}
+
+// setDigests sets the digest fields of the response, as headers if
+// prefix is empty or trailers if prefix is http.TrailerPrefix. It does
+// nothing if they have already been set, or if the response has no
+// body.
+func (w *gzipResponseWriter) setDigests(prefix string) {
+	dg := w.digest
+	if dg == nil || dg.sent || w.discard ||
+		w.httpStatus == http.StatusNoContent ||
+		w.httpStatus == http.StatusNotModified {
+		return
+	}
+	dg.sent = true
+	if dg.content != nil {
+		w.Header().Set(prefix+"Content-Digest",
+			digestValue(dg.contentAlg, dg.content))
+	}
+	if dg.repr != nil && w.httpStatus != http.StatusPartialContent {
+		w.Header().Set(prefix+"Repr-Digest",
+			digestValue(dg.reprAlg, dg.repr))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func sha512Digest(b []byte) string {
+	sum := sha512.Sum512(b)
+	return "sha-512=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// TestDigests checks the Content-Digest and Repr-Digest fields sent
+// with streamed and buffered responses, with and without compression,
+// and with various Want- headers.
+func TestDigests(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		_, _ = w.Write(data[:n])
+	})
+	c := &httpgzip.Config{
+		Digests: &httpgzip.Digests{
+			Content:    true,
+			Repr:       true,
+			Algorithms: []string{"sha-256", "sha-512"},
+		},
+	}
+	const (
+		none = iota
+		header
+		trailer
+	)
+	for _, tc := range []struct {
+		n       int
+		headers []string
+		where   int
+		content func([]byte) string
+		repr    func([]byte) string
+	}{
+		// streamed and compressed
+		{4096, []string{"Accept-Encoding: gzip"},
+			trailer, sha256Digest, sha256Digest},
+		// buffered and compressed
+		{300, []string{"Accept-Encoding: gzip, identity;q=0"},
+			header, sha256Digest, sha256Digest},
+		// buffered and not compressed
+		{300, []string{"Accept-Encoding: gzip"},
+			header, sha256Digest, sha256Digest},
+		// streamed and not compressed
+		{4096, []string{"Accept-Encoding: identity"},
+			trailer, sha256Digest, sha256Digest},
+		{4096, []string{"Accept-Encoding: gzip",
+			"Want-Content-Digest: sha-512=3, sha-256=1",
+			"Want-Repr-Digest: sha-256=0"},
+			trailer, sha512Digest, nil},
+		{300, []string{"Accept-Encoding: gzip",
+			"Want-Content-Digest: md5=10",
+			"Want-Repr-Digest: sha-256=1, sha-512=2"},
+			header, nil, sha512Digest},
+	} {
+		res, body := getPathConfig(t, h, defComp, c,
+			"/?n="+strconv.Itoa(tc.n), tc.headers)
+		fields := res.Header
+		if tc.where == trailer {
+			fields = res.Trailer
+		}
+		for _, f := range []struct {
+			name   string
+			digest func([]byte) string
+			data   []byte
+		}{
+			{"Content-Digest", tc.content, body},
+			// the representation includes the content
+			// coding, and the responses are complete
+			{"Repr-Digest", tc.repr, body},
+		} {
+			var expected string
+			if f.digest != nil {
+				expected = f.digest(f.data)
+			}
+			if got := fields.Get(f.name); got != expected {
+				t.Fatalf("\nsize %d, headers %v\n%s expected %q, got %q\n",
+					tc.n, tc.headers, f.name, expected, got)
+			}
+		}
+	}
+	c = &httpgzip.Config{Digests: &httpgzip.Digests{
+		Content:    true,
+		OnlyWanted: true,
+	}}
+	res, _ := getPathConfig(t, h, defComp, c, "/?n=300", nil)
+	if res.Header.Get("Content-Digest") != "" {
+		t.Fatalf("\nunexpected Content-Digest\n")
+	}
+	c = &httpgzip.Config{Digests: &httpgzip.Digests{
+		Algorithms: []string{"md5"},
+	}}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for unsupported algorithm\n")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"fmt"
+	"math"
+)
+
+// entropySample is the maximum number of bytes examined by
+// expectedSaving.
+const entropySample = 4096
+
+// expectedSaving returns an estimate of the fraction of the size of
+// data like p which compression would save. It is based on the order-0
+// entropy of up to the first entropySample bytes of p, so it ignores
+// the repeated strings compression also exploits, and underestimates
+// the saving for most text.
+func expectedSaving(p []byte) float64 {
+	if len(p) > entropySample {
+		p = p[:entropySample]
+	}
+	if len(p) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var bits float64
+	n := float64(len(p))
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c) / n
+			bits -= f * math.Log2(f)
+		}
+	}
+	return 1 - bits/8
+}
+
+// checkMinSaving returns an error if s is not a valid MinSaving.
+func checkMinSaving(s float64) error {
+	if s < 0 || s >= 1 || math.IsNaN(s) {
+		return fmt.Errorf("httpgzip: invalid minimum saving: %v", s)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestMinSaving checks that responses containing text are compressed,
+// and responses containing random data, raw or base64 encoded, are
+// not, by a handler whose Config has MinSaving 0.3.
+func TestMinSaving(t *testing.T) {
+	text, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	bodies := map[string][]byte{
+		"/text":   text,
+		"/random": random,
+		"/base64": []byte(base64.StdEncoding.EncodeToString(random)),
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(bodies[r.URL.Path])
+	})
+	skipc := make(chan httpgzip.SkipReason, 1)
+	c := &httpgzip.Config{
+		MinSaving: 0.3,
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				skipc <- s.Skip
+			}),
+	}
+	for _, tc := range []struct {
+		path string
+		skip httpgzip.SkipReason
+	}{
+		{"/text", httpgzip.NotSkipped},
+		{"/random", httpgzip.SkipIncompressible},
+		{"/base64", httpgzip.SkipIncompressible},
+	} {
+		res, _ := getPathConfig(t, h, defComp, c, tc.path,
+			[]string{"Accept-Encoding: gzip, identity"})
+		if skip := <-skipc; skip != tc.skip {
+			t.Fatalf("\npath %s, expected skip reason %v, got %v\n",
+				tc.path, tc.skip, skip)
+		}
+		gzipped := res.Header.Get("Content-Encoding") == "gzip"
+		if gzipped != (tc.skip == httpgzip.NotSkipped) {
+			t.Fatalf("\npath %s, unexpected Content-Encoding %q\n",
+				tc.path, res.Header.Get("Content-Encoding"))
+		}
+	}
+	// requests only accepting gzip are always compressed
+	res, _ := getPathConfig(t, h, defComp, c, "/random",
+		[]string{"Accept-Encoding: gzip, identity;q=0"})
+	<-skipc
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("\nexpected gzipped response\n")
+	}
+	for _, s := range []float64{-0.1, 1} {
+		c := &httpgzip.Config{MinSaving: s}
+		if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+			t.Fatalf("\nMinSaving %v, expected error\n", s)
+		}
+	}
+}
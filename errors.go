@@ -0,0 +1,93 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"net/http"
+)
+
+// An Error describes a failure to write a response. It is passed to
+// the OnError function of a Config, and is the Err field of the
+// response's Stats. If neither Compressor nor Decoder is true the
+// error was returned by the underlying http.ResponseWriter, usually
+// because the client has gone away.
+type Error struct {
+	// Op is "write" if the error occurred while the wrapped handler
+	// was writing the response, or "close" if it occurred while the
+	// end of the response was written after the handler returned.
+	Op string
+	// Compressor is true if the error was returned by the
+	// compressor.
+	Compressor bool
+	// Decoder is true if the error was returned decoding a response
+	// the wrapped handler had encoded, because of the Config's
+	// Transcode field, for example because it was truncated or
+	// corrupt.
+	Decoder bool
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "httpgzip: " + e.kind() + " " + e.Op + " error: " + e.Err.Error()
+}
+
+// Unwrap returns e.Err.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// kind returns the label under which Metrics counts e.
+func (e *Error) kind() string {
+	switch {
+	case e.Compressor:
+		return "compressor"
+	case e.Decoder:
+		return "decoder"
+	}
+	return "client"
+}
+
+// fail records e, after setting its Op, as the error writing the
+// response if it is the first, and reports it to w.logger and
+// w.onError. If e.Compressor is true the compressor is then in an
+// unknown state and must not be used again.
+func (w *gzipResponseWriter) fail(e *Error) {
+	if w.failed != nil {
+		return
+	}
+	e.Op = "write"
+	if w.closing {
+		e.Op = "close"
+	}
+	w.failed = e
+	if w.logger != nil {
+		w.logError()
+	}
+	if w.onError != nil {
+		w.onError(w.req, w.failed)
+	}
+}
+
+// compressorFailed reports whether the compressor has returned an
+// error.
+func (w *gzipResponseWriter) compressorFailed() bool {
+	return w.failed != nil && w.failed.Compressor
+}
+
+// aborting reports whether the response must be aborted because the
+// compressor or decoder failed.
+func (w *gzipResponseWriter) aborting() bool {
+	return w.failed != nil && (w.failed.Compressor || w.failed.Decoder)
+}
+
+// abort aborts the response by panicking with http.ErrAbortHandler,
+// which makes net/http close the connection, so that the client does
+// not receive a truncated compressed response which may look
+// complete. It must only be called on the handler's goroutine, since
+// nothing recovers the panic on any other.
+func abort() {
+	panic(http.ErrAbortHandler)
+}
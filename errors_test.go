@@ -0,0 +1,276 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xi2/httpgzip"
+)
+
+// failingEncoder is a DictionaryEncoder whose writers fail in Write
+// or, if onClose is true, in Close.
+type failingEncoder struct {
+	onClose bool
+}
+
+func (failingEncoder) Coding() string { return "dcz" }
+
+func (e failingEncoder) NewWriter(w io.Writer, dict []byte) (io.WriteCloser, error) {
+	return failingWriter(e), nil
+}
+
+type failingWriter failingEncoder
+
+var errEncoder = errors.New("encoder failed")
+
+func (fw failingWriter) Write(p []byte) (int, error) {
+	if fw.onClose {
+		return len(p), nil
+	}
+	return 0, errEncoder
+}
+
+func (fw failingWriter) Close() error { return errEncoder }
+
+// failingResponseWriter is an http.ResponseWriter whose Write method
+// fails, as when the client has gone away.
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+var errClient = errors.New("client gone")
+
+func (failingResponseWriter) Write(p []byte) (int, error) {
+	return 0, errClient
+}
+
+// TestErrors checks that failures of the compressor, when writing
+// and closing, are reported and abort the response, including when
+// the response is being transcoded, that failures decoding a
+// transcoded response are reported and abort it, and that failures
+// writing to the client are reported.
+func TestErrors(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflated := zlibData(t, data)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := data
+		if r.URL.Path == "/deflate" {
+			w.Header().Set("Content-Encoding", "deflate")
+			p = deflated
+		}
+		_, _ = w.Write(p[:len(p)/2])
+		_, _ = w.Write(p[len(p)/2:])
+	})
+	store := &httpgzip.MemoryDictionaryStore{}
+	store.Add(data)
+	hash := sha256.Sum256(data)
+	headers := []string{
+		"Accept-Encoding: gzip, dcz",
+		"Available-Dictionary: :" +
+			base64.StdEncoding.EncodeToString(hash[:]) + ":",
+	}
+	errc := make(chan error, 1)
+	m := &httpgzip.Metrics{}
+	for _, tc := range []struct {
+		onClose   bool
+		transcode bool
+		op        string
+	}{
+		{false, false, "write"},
+		{true, false, "close"},
+		{false, true, "write"},
+		{true, true, "close"},
+	} {
+		path := "/"
+		if tc.transcode {
+			path = "/deflate"
+		}
+		c := &httpgzip.Config{
+			Transcode: tc.transcode,
+			Observer:  m,
+			OnError: func(r *http.Request, err error) {
+				errc <- err
+			},
+			Dictionaries: &httpgzip.DictionaryTransport{
+				Store: store,
+				Encoders: []httpgzip.DictionaryEncoder{
+					failingEncoder{tc.onClose}},
+			},
+		}
+		gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(gzh)
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for _, h := range headers {
+			req.Header.Add(parseHeader(h))
+		}
+		client := http.Client{
+			Transport: &http.Transport{DisableCompression: true},
+		}
+		res, err := client.Do(req)
+		if err == nil {
+			_, err = ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+		}
+		ts.Close()
+		if err == nil {
+			t.Fatalf("\npath %s, op %s, expected aborted response\n",
+				path, tc.op)
+		}
+		var e *httpgzip.Error
+		if err := <-errc; !errors.As(err, &e) || !e.Compressor ||
+			e.Op != tc.op || !errors.Is(err, errEncoder) {
+			t.Fatalf("\npath %s, op %s, unexpected error %v\n",
+				path, tc.op, err)
+		}
+	}
+	// a truncated upstream response which cannot be fully decoded
+	truncated := gzipData(t, data)
+	truncated = truncated[:len(truncated)/2]
+	th := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(truncated)
+	})
+	c := &httpgzip.Config{
+		Transcode: true,
+		Observer:  m,
+		OnError: func(r *http.Request, err error) {
+			errc <- err
+		},
+	}
+	gzh, err := httpgzip.NewHandlerConfig(th, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gzh)
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	client := http.Client{
+		Transport: &http.Transport{DisableCompression: true},
+	}
+	res, err := client.Do(req)
+	if err == nil {
+		_, err = ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+	}
+	ts.Close()
+	if err == nil {
+		t.Fatalf("\ntruncated upstream, expected aborted response\n")
+	}
+	var de *httpgzip.Error
+	if err := <-errc; !errors.As(err, &de) || !de.Decoder {
+		t.Fatalf("\ntruncated upstream, unexpected error %v\n", err)
+	}
+	c = &httpgzip.Config{
+		Observer: m,
+		OnError: func(r *http.Request, err error) {
+			errc <- err
+		},
+	}
+	gzh, err = httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	gzh.ServeHTTP(failingResponseWriter{httptest.NewRecorder()}, req)
+	var e *httpgzip.Error
+	if err := <-errc; !errors.As(err, &e) || e.Compressor ||
+		!errors.Is(err, errClient) {
+		t.Fatalf("\nunexpected client error %v\n", err)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`httpgzip_errors_total{kind="client"} 1`,
+		`httpgzip_errors_total{kind="compressor"} 4`,
+		`httpgzip_errors_total{kind="decoder"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Fatalf(
+				"\nexpected line %s in Prometheus metrics, got\n%s",
+				line, rec.Body.String())
+		}
+	}
+}
+
+// TestNoBodyErrors requests, accepting only gzip encoding, a file
+// from an http.FileServer with a 304 Not Modified response, and a
+// response with 204 No Content status whose handler writes a body
+// regardless. It checks that neither is compressed or reported as an
+// error.
+func TestNoBodyErrors(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := http.FileServer(http.Dir("testdata"))
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nocontent" {
+			w.WriteHeader(http.StatusNoContent)
+			_, _ = w.Write(data)
+			return
+		}
+		fs.ServeHTTP(w, r)
+	})
+	var errs []error
+	var skips []httpgzip.SkipReason
+	c := &httpgzip.Config{
+		OnError: func(r *http.Request, err error) {
+			errs = append(errs, err)
+		},
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				skips = append(skips, s.Skip)
+			}),
+	}
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/4096bytes.txt", http.StatusNotModified},
+		{"/nocontent", http.StatusNoContent},
+	} {
+		res, body := getPathConfig(t, h, defComp, c, tc.path, []string{
+			"Accept-Encoding: gzip, identity;q=0",
+			"If-Modified-Since: " +
+				time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+		})
+		if res.StatusCode != tc.status {
+			t.Fatalf("\npath %s, expected status %d, got %d\n",
+				tc.path, tc.status, res.StatusCode)
+		}
+		if ce := res.Header.Get("Content-Encoding"); ce != "" ||
+			len(body) != 0 {
+			t.Fatalf("\npath %s, unexpected Content-Encoding %q "+
+				"and body length %d\n", tc.path, ce, len(body))
+		}
+	}
+	if len(errs) != 0 {
+		t.Fatalf("\nunexpected errors %v\n", errs)
+	}
+	if len(skips) != 2 || skips[0] != httpgzip.SkipNoBody ||
+		skips[1] != httpgzip.SkipNoBody {
+		t.Fatalf("\nunexpected skip reasons %v\n", skips)
+	}
+}
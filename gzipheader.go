@@ -0,0 +1,86 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/xi2/httpgzip/internal/gzip"
+)
+
+// A GzipHeader holds the metadata written in the header of a gzip
+// compressed response. It is returned by the GzipHeader function of a
+// Config.
+type GzipHeader struct {
+	// Name is the name of the uncompressed file. Characters which
+	// are not in ISO 8859-1 are replaced by underscores.
+	Name string
+	// Comment is a comment. Characters which are not in ISO 8859-1
+	// are replaced by underscores.
+	Comment string
+	// ModTime is the modification time of the uncompressed file.
+	// It is not written if it is zero.
+	ModTime time.Time
+	// OS, if not nil, identifies the operating system the file came
+	// from, using the values listed in RFC 1952, in which 0 is FAT.
+	// If nil, 255 (unknown) is used.
+	OS *byte
+}
+
+// FileGzipHeader is a function suitable for the GzipHeader field of a
+// Config. It takes the Name from the filename in the response's
+// Content-Disposition header, or else from the last element of the
+// request's path, and the ModTime from the response's Last-Modified
+// header, so that compressed responses saved as .gz files decompress
+// with sensible names and timestamps.
+func FileGzipHeader(r *http.Request, h http.Header) GzipHeader {
+	var gh GzipHeader
+	if _, params, err := mime.ParseMediaType(
+		h.Get("Content-Disposition")); err == nil {
+		gh.Name = path.Base(params["filename"])
+	}
+	if gh.Name == "" || gh.Name == "." || gh.Name == "/" {
+		gh.Name = path.Base(r.URL.Path)
+		if gh.Name == "." || gh.Name == "/" {
+			gh.Name = ""
+		}
+	}
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		gh.ModTime = t
+	}
+	return gh
+}
+
+// latin1 returns s with any characters not in ISO 8859-1, and any
+// zero bytes, replaced by underscores.
+func latin1(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == 0 || r > 0xff {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// gzipHeader returns the gzip header to write for the response, using
+// w.headerFunc if it is not nil.
+func (w *gzipResponseWriter) gzipHeader() gzip.Header {
+	h := gzip.Header{OS: 255}
+	if w.headerFunc == nil {
+		return h
+	}
+	gh := w.headerFunc(w.req, w.Header())
+	h.Name = latin1(gh.Name)
+	h.Comment = latin1(gh.Comment)
+	h.ModTime = gh.ModTime
+	if gh.OS != nil {
+		h.OS = *gh.OS
+	}
+	return h
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestGzipHeader checks the gzip headers written using FileGzipHeader,
+// and a function setting every field, with and without parallel
+// compression.
+func TestGzipHeader(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/download" {
+			w.Header().Set("Content-Disposition",
+				`attachment; filename*=UTF-8''r%C3%A9sum%E2%82%AC.txt`)
+			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		}
+		_, _ = w.Write(data)
+	})
+	custom := func(os byte) func(r *http.Request, h http.Header) httpgzip.GzipHeader {
+		return func(r *http.Request, h http.Header) httpgzip.GzipHeader {
+			return httpgzip.GzipHeader{
+				Name:    "custom.txt",
+				Comment: "a comment",
+				ModTime: modTime,
+				OS:      &os,
+			}
+		}
+	}
+	for _, parallel := range []int64{0, 1024} {
+		for _, tc := range []struct {
+			fn      func(r *http.Request, h http.Header) httpgzip.GzipHeader
+			path    string
+			name    string
+			comment string
+			modTime time.Time
+			os      byte
+		}{
+			{nil, "/download", "", "", time.Time{}, 255},
+			{httpgzip.FileGzipHeader, "/download", "résum_.txt", "",
+				modTime, 255},
+			{httpgzip.FileGzipHeader, "/files/report.txt", "report.txt",
+				"", time.Time{}, 255},
+			{httpgzip.FileGzipHeader, "/", "", "", time.Time{}, 255},
+			{custom(3), "/", "custom.txt", "a comment", modTime, 3},
+			{custom(0), "/", "custom.txt", "a comment", modTime, 0},
+		} {
+			c := &httpgzip.Config{
+				GzipHeader:        tc.fn,
+				ParallelThreshold: parallel,
+			}
+			_, body := getPathConfig(t, h, defComp, c, tc.path,
+				[]string{"Accept-Encoding: gzip"})
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("\npath %s, body differs (err %v)\n", tc.path, err)
+			}
+			if zr.Name != tc.name || zr.Comment != tc.comment ||
+				!zr.ModTime.Equal(tc.modTime) || zr.OS != tc.os {
+				t.Fatalf(
+					"\npath %s, parallel %d\nexpected %q, %q, %v, %d\ngot %q, %q, %v, %d\n",
+					tc.path, parallel,
+					tc.name, tc.comment, tc.modTime, tc.os,
+					zr.Name, zr.Comment, zr.ModTime, zr.OS)
+			}
+		}
+	}
+}
@@ -23,6 +23,47 @@
 // set using http.DetectContentType if it is not set by the wrapped
 // handler.
 //
+// Debugging
+//
+// A Config can enable debug headers, either for all responses or for
+// requests carrying a given header, so that compression can be
+// verified from a browser. The X-Httpgzip-Decision header gives the
+// content coding of the response and, if it was not gzip compressed,
+// the reason, for example "gzip; level=6" or "identity;
+// reason=too-small". The X-Httpgzip-Original-Size and
+// X-Httpgzip-Compressed-Size headers give the number of bytes
+// written by the wrapped handler and sent to the client. They are
+// sent as trailers if they are not known when the response headers
+// are written.
+//
+// Proxies
+//
+// NewProxyHandler returns a variant of the http.Handler wrapper for
+// use with reverse proxies. It passes through responses already
+// encoded by the proxied server if the client accepts their encoding,
+// and decodes and recompresses them as appropriate if not.
+//
+// Request bodies
+//
+// NewRequestHandler returns a separate http.Handler wrapper which
+// decompresses the bodies of requests sent with a Content-Encoding
+// header, such as those uploaded by clients with "Content-Encoding:
+// gzip".
+//
+// Clients
+//
+// Transport is an http.RoundTripper which requests and transparently
+// decodes compressed responses, supporting more content codings than
+// http.Transport does.
+//
+// Compression dictionaries
+//
+// A Config can enable Compression Dictionary Transport (RFC 9842),
+// serving responses compressed against an earlier version of the same
+// resource held by the client, using the "dcb" (Brotli) or "dcz"
+// (Zstandard) content codings. The compressors must be supplied by the
+// caller.
+//
 // Gzip implementation
 //
 // By default, httpgzip uses the standard library gzip
@@ -45,13 +86,17 @@ package httpgzip
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"log/slog"
 	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/xi2/httpgzip/internal/gzip"
+	"github.com/xi2/httpgzip/internal/pgzip"
 )
 
 // These constants are copied from the gzip package, so that code that
@@ -103,37 +148,49 @@ var DefaultContentTypes = []string{
 	"text/xml",
 }
 
-var gzipWriterPools = map[int]*sync.Pool{}
+var gzipBufPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// A countingWriter is an io.Writer which counts the bytes written to
+// the underlying io.Writer and, if timed is true, the time spent
+// writing them. If h is not nil the bytes are also written to h. The
+// first error returned by the underlying io.Writer is kept in err.
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	timed bool
+	d     time.Duration
+	h     io.Writer
+	err   error
+}
 
-func init() {
-	levels := map[int]struct{}{
-		DefaultCompression: struct{}{},
-		NoCompression:      struct{}{},
+func (c *countingWriter) Write(p []byte) (int, error) {
+	var t time.Time
+	if c.timed {
+		t = time.Now()
 	}
-	for i := BestSpeed; i <= BestCompression; i++ {
-		levels[i] = struct{}{}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
 	}
-	for k := range levels {
-		level := k // create new variable for closure
-		gzipWriterPools[level] = &sync.Pool{
-			New: func() interface{} {
-				w, _ := gzip.NewWriterLevel(nil, level)
-				return w
-			},
-		}
+	if c.h != nil {
+		_, _ = c.h.Write(p[:n])
 	}
-}
-
-var gzipBufPool = sync.Pool{
-	New: func() interface{} { return new(bytes.Buffer) },
+	if c.timed {
+		c.d += time.Since(t)
+	}
+	return n, err
 }
 
 // A gzipResponseWriter is a modified http.ResponseWriter. It adds
 // gzip compression to certain responses, and there are two cases
 // where this is done. Case 1 is when encs only allows gzip encoding
 // and forbids identity. Case 2 is when encs prefers gzip encoding,
-// the response is at least 512 bytes and the response's content type
-// is in ctMap.
+// the response is at least 512 bytes, the response's content type is
+// in ctMap and, if minSaving is positive, the start of the response is
+// expected to compress by at least minSaving (see expectedSaving).
 //
 // A gzipResponseWriter sets the Content-Encoding and Content-Type
 // headers when appropriate. It is important to call the Close method
@@ -141,16 +198,128 @@ var gzipBufPool = sync.Pool{
 // gzipResponseWriter. The slice encs must contain only encodings from
 // {encGzip,encIdentity} and contain at least one encoding.
 //
-// If a gzip.Writer is used in order to write a response it will use a
-// compression level of level.
+// If a gzip.Writer is used in order to write a response it is taken
+// from pool and will use a compression level of level, or the level
+// given for the response's media type in levels.
+//
+// If parallel.threshold is positive a pgzip.Writer is used instead of
+// a gzip.Writer, so that large responses are compressed using several
+// goroutines.
+//
+// If dicts is not nil the response may be compressed against a
+// dictionary instead, using the content coding in coding, and may be
+// added to dicts.Store (see dictionary.go).
+//
+// If preset is not nil and the request accepts its content coding
+// the response may be compressed using its dictionary instead (see
+// preset.go).
+//
+// If te is true the gzip transfer coding is used instead of the gzip
+// content coding, and encs must contain encIdentity (see te.go).
+//
+// If headerFunc is not nil it gives the metadata written in the
+// gzip header (see gzipheader.go).
+//
+// If digest is not nil the digests of the response are computed and
+// sent (see digest.go). The digests are computed by cw, unless te is
+// true.
+//
+// If bufferLimit is positive the compressed response is held in out
+// until it is complete or exceeds bufferLimit bytes. Otherwise it is
+// only held if it is compressed by Close and headers depending on it,
+// such as Server-Timing, are to be set.
+//
+// If the request's method is HEAD the response gets the headers it
+// would have if compressed, but nothing is compressed and noBody is
+// set, so that nothing is written which net/http would count towards
+// a Content-Length header. If the response's status does not allow a
+// body it is not compressed and noBody is set, so that writing a body
+// is not reported as an error.
+//
+// The first error writing the response is kept in failed and passed
+// to onError if it is not nil (see errors.go).
+//
+// If breach is not nil it may skip compressing the response or pad it
+// (see breach.go).
+//
+// If transcode is true, responses which the wrapped handler has
+// already encoded using a content coding not acceptable according to
+// the q-values in accept are decoded by dec before being treated as
+// above (see checkEncoding).
+//
+// The bytes written to the client are counted by cw. If obs is not
+// nil then Close passes statistics about the response to obs, in
+// which case cw.timed should be true so that the time spent
+// compressing can be measured. If logger is not nil then init logs
+// its decision to logger. If debug is true then headers explaining
+// the decision are added to the response (see debug.go). If adaptive
+// is not nil then it may lower the compression level used, in which
+// case cw.timed should be true. If sem is not nil then a slot in it
+// must be acquired before compressing (see limit.go).
 type gzipResponseWriter struct {
 	http.ResponseWriter
-	httpStatus int
-	ctMap      map[string]struct{}
-	encs       []encoding
-	level      int
-	gw         *gzip.Writer
-	buf        *bytes.Buffer
+	httpStatus   int
+	ctMap        map[string]struct{}
+	encs         []encoding
+	level        int
+	gw           compressor
+	gwPool       string // coding gw is pooled under
+	buf          *bytes.Buffer
+	transcode    bool
+	accept       map[string]float64
+	checked      bool
+	dec          *decodingWriter
+	cw           countingWriter
+	n            int64         // bytes passed to write
+	ctime        time.Duration // time spent compressing
+	ct           string        // content type
+	skip         SkipReason
+	pool         *EncoderPool
+	poolMiss     bool // whether gw was newly allocated
+	req          *http.Request
+	obs          Observer
+	logger       *slog.Logger
+	debug        bool           // whether to add debug headers
+	serverTiming bool           // whether to add a Server-Timing header
+	closing      bool           // whether Close has been called
+	levels       map[string]int // compression levels by media type
+	adaptive     *AdaptiveLevel
+	adapting     bool // whether adaptive.release must be called
+	sem          chan struct{}
+	semWait      time.Duration
+	holdingSem   bool // whether a slot in sem is held
+	discard      bool // whether to discard the response body
+	noBody       bool // whether the response has no body to write
+	parallel     parallelConfig
+	minSaving    float64 // see Config.MinSaving
+	breach       *BreachMitigation
+	padHTML      bool   // whether to end the response with padding
+	unpadded     bool   // whether padding was impossible
+	coding       string // content coding used if compressing
+	dicts        *DictionaryTransport
+	dictBuf      *bytes.Buffer // copy of a response to add to dicts.Store
+	preset       *PresetDictionary
+	te           bool // whether to use the gzip transfer coding
+	headerFunc   func(r *http.Request, h http.Header) GzipHeader
+	digest       *digester
+	out          *bytes.Buffer // compressed output held back
+	bufferLimit  int64         // see Config.BufferLimit
+	onError      func(r *http.Request, err error)
+	failed       *Error // first error writing the response
+}
+
+// A compressor is a gzip.Writer or pgzip.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// A parallelConfig holds the parallel compression fields of a
+// Config.
+type parallelConfig struct {
+	threshold int64
+	blockSize int
+	workers   int
 }
 
 func newGzipResponseWriter(w http.ResponseWriter, ctMap map[string]struct{}, encs []encoding, level int) *gzipResponseWriter {
@@ -162,16 +331,19 @@ func newGzipResponseWriter(w http.ResponseWriter, ctMap map[string]struct{}, enc
 		ctMap:          ctMap,
 		encs:           encs,
 		level:          level,
-		buf:            buf}
+		buf:            buf,
+		coding:         "gzip",
+		cw:             countingWriter{w: w}}
 }
 
 // init gets called by Write once at least 512 bytes have been written
 // to the temporary buffer buf, or by Close if it has not yet been
 // called. Firstly it determines the content type, either from the
 // Content-Type header, or by calling http.DetectContentType on
-// buf. Then, if needed, a gzip.Writer is initialized. Lastly,
-// appropriate headers are set and the ResponseWriter's WriteHeader
-// method is called.
+// buf. Then, if needed, a gzip.Writer is initialized, or if not the
+// reason is recorded in skip. Lastly, appropriate headers are
+// set. The caller must then call the ResponseWriter's WriteHeader
+// method.
 func (w *gzipResponseWriter) init() {
 	cth := w.Header().Get("Content-Type")
 	var ct string
@@ -180,34 +352,148 @@ func (w *gzipResponseWriter) init() {
 	} else {
 		ct = http.DetectContentType(w.buf.Bytes())
 	}
-	var gzipContentType bool
+	var gzipContentType, isHTML bool
 	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		isHTML = mt == "text/html"
 		if _, ok := w.ctMap[mt]; ok {
 			gzipContentType = true
 		}
+		if level, ok := mediaTypeLevel(w.levels, mt); ok {
+			w.level = level
+		}
 	}
+	w.ct = ct
 	var useGzip bool
-	if w.Header().Get("Content-Encoding") == "" && w.encs[0] == encGzip {
-		if gzipContentType && w.buf.Len() >= 512 || len(w.encs) == 1 {
-			useGzip = true
+	switch {
+	case w.discard:
+		// the response is being replaced by an error status
+		// (see notAcceptable), and skip is already set
+	case !bodyAllowedForStatus(w.httpStatus):
+		// nothing may be written, not even an empty gzip stream
+		w.skip = SkipNoBody
+		w.noBody = true
+	case w.Header().Get("Content-Encoding") != "":
+		w.skip = SkipPresetEncoding
+	case w.encs[0] != encGzip && !w.te:
+		w.skip = SkipClientRefused
+	case !w.identityOK():
+		useGzip = true
+	case w.breach != nil && w.breach.skip(w.Header(), w.req):
+		w.skip = SkipBreach
+	case !gzipContentType:
+		w.skip = SkipContentType
+	case w.buf.Len() < 512:
+		w.skip = SkipTooSmall
+	case w.minSaving > 0 && expectedSaving(w.buf.Bytes()) < w.minSaving:
+		w.skip = SkipIncompressible
+	default:
+		useGzip = true
+	}
+	// the response to a HEAD request gets the headers it would have
+	// if compressed, but nothing is compressed
+	head := w.req.Method == "HEAD"
+	if useGzip && w.sem != nil && !head {
+		if w.acquireCompressor() {
+			w.holdingSem = true
+		} else {
+			useGzip = false
+			w.skip = SkipConcurrency
+			if !w.identityOK() {
+				w.unavailable()
+			}
+		}
+	}
+	if useGzip && w.adaptive != nil && !head {
+		level, skip := w.adaptive.acquire(w.level, w.identityOK())
+		if skip {
+			useGzip = false
+			w.skip = SkipAdaptive
+			w.releaseCompressor()
+		} else {
+			w.level = level
+			w.adapting = true
 		}
 	}
+	var dw *dictWriter
+	if useGzip && w.dicts != nil && !w.te {
+		if dw = w.chooseDictionary(); dw != nil {
+			w.coding = dw.enc.Coding()
+		}
+	}
+	if useGzip && dw == nil && w.preset != nil && !w.te &&
+		w.preset.accepted(w.req) {
+		w.coding = w.preset.Coding
+	}
+	if w.logger != nil {
+		w.logDecision()
+	}
+	if w.debug {
+		w.setDebugHeaders()
+	}
 	if useGzip {
-		w.gw = gzipWriterPools[w.level].Get().(*gzip.Writer)
-		w.gw.Reset(w.ResponseWriter)
+		switch {
+		case head:
+			w.noBody = true
+		case dw != nil:
+			w.gw, w.gwPool = dw, ""
+		case w.coding != "gzip":
+			w.getPresetCompressor()
+		default:
+			w.getCompressor()
+		}
+		if w.gw != nil {
+			h := w.gzipHeader()
+			w.pad(isHTML, &h)
+			w.setGzipHeader(h)
+		}
 		w.Header().Del("Content-Length")
-		w.Header().Set("Content-Encoding", "gzip")
+		if w.te {
+			w.Header().Set("Transfer-Encoding", "gzip")
+		} else {
+			w.Header().Set("Content-Encoding", w.coding)
+		}
 	}
-	w.Header().Del("Accept-Ranges")
-	if cth == "" {
-		w.Header().Set("Content-Type", ct)
+	if w.encs[0] == encGzip && !w.te && !w.discard &&
+		w.skip != SkipNoBody {
+		w.Header().Del("Accept-Ranges")
+		if cth == "" {
+			w.Header().Set("Content-Type", ct)
+		}
 	}
-	w.ResponseWriter.WriteHeader(w.httpStatus)
 }
 
 func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.checked {
+		w.checkEncoding()
+	}
+	var n int
+	var err error
+	if w.dec != nil {
+		n, err = w.dec.Write(p)
+		if err != nil {
+			// unless writing the decoded response failed, the
+			// error was returned by the decoder
+			w.fail(&Error{Decoder: true, Err: err})
+		}
+	} else {
+		n, err = w.write(p)
+	}
+	if w.aborting() {
+		// output may have run on the decoding goroutine, so the
+		// response is aborted here, on the handler's goroutine
+		abort()
+	}
+	return n, err
+}
+
+// write does the work of Write once any decoding of the response
+// has been done.
+func (w *gzipResponseWriter) write(p []byte) (int, error) {
 	var n, written int
 	var err error
+	w.n += int64(len(p))
+	w.teeDictionary(p)
+	w.hashUncompressed(p)
 	if w.buf != nil {
 		written = w.buf.Len()
 		_, _ = w.buf.Write(p)
@@ -215,18 +501,18 @@ func (w *gzipResponseWriter) Write(p []byte) (int, error) {
 			return len(p), nil
 		}
 		w.init()
+		if w.gw != nil && w.bufferLimit > 0 && !w.te {
+			w.holdOutput()
+		} else {
+			w.ResponseWriter.WriteHeader(w.httpStatus)
+		}
 		p = w.buf.Bytes()
 		defer func() {
 			gzipBufPool.Put(w.buf)
 			w.buf = nil
 		}()
 	}
-	switch {
-	case w.gw != nil:
-		n, err = w.gw.Write(p)
-	default:
-		n, err = w.ResponseWriter.Write(p)
-	}
+	n, err = w.output(p)
 	n -= written
 	if n < 0 {
 		n = 0
@@ -234,13 +520,207 @@ func (w *gzipResponseWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// holdOutput makes w hold the compressed response in w.out instead
+// of writing it to the client, so that headers depending on the
+// compressed response can be set before the ResponseWriter's
+// WriteHeader method is called.
+func (w *gzipResponseWriter) holdOutput() {
+	w.out = gzipBufPool.Get().(*bytes.Buffer)
+	w.out.Reset()
+	w.cw.w = w.out
+}
+
+// flushHeld gets called by output once more than w.bufferLimit
+// compressed bytes are held. It writes the response header and the
+// bytes held, and makes w write the rest of the response to the client
+// as it is compressed.
+func (w *gzipResponseWriter) flushHeld() error {
+	out := w.out
+	w.out = nil
+	defer gzipBufPool.Put(out)
+	w.cw.w = w.ResponseWriter
+	w.ResponseWriter.WriteHeader(w.httpStatus)
+	_, err := out.WriteTo(w.ResponseWriter)
+	return err
+}
+
+// writeHeld gets called by Close, once the compressor has been
+// closed, to write a response held in w.out. It first sets any headers
+// depending on the compressed response, including the Content-Length
+// header if w.bufferLimit is positive, unless the gzip transfer coding
+// is in use or the response has no body.
+func (w *gzipResponseWriter) writeHeld() error {
+	out := w.out
+	w.out = nil
+	defer gzipBufPool.Put(out)
+	w.cw.w = w.ResponseWriter
+	if w.bufferLimit > 0 && !w.te && !w.discard && w.bodyAllowed() {
+		w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	}
+	if w.serverTiming {
+		w.Header().Add("Server-Timing", w.timing())
+	}
+	if w.debug {
+		w.Header().Set(originalSizeHeader, strconv.FormatInt(w.n, 10))
+		w.Header().Set(compressedSizeHeader, strconv.Itoa(out.Len()))
+	}
+	w.setDigests("")
+	w.ResponseWriter.WriteHeader(w.httpStatus)
+	_, err := out.WriteTo(w.ResponseWriter)
+	return err
+}
+
+// getCompressor takes a compressor from w.pool and resets it to write
+// to w.cw. A pgzip.Writer is used if w.parallel.threshold is positive.
+func (w *gzipResponseWriter) getCompressor() {
+	level := w.level
+	if w.parallel.threshold <= 0 {
+		w.gwPool = "gzip"
+		gw, miss := w.pool.get(w.gwPool, level, func() interface{} {
+			gw, _ := gzip.NewWriterLevel(nil, level)
+			return gw
+		})
+		w.gw, w.poolMiss = gw.(*gzip.Writer), miss
+	} else {
+		w.gwPool = "gzip-parallel"
+		gw, miss := w.pool.get(w.gwPool, level, func() interface{} {
+			gw, _ := pgzip.NewWriterLevel(nil, level)
+			return gw
+		})
+		pw := gw.(*pgzip.Writer)
+		pw.Threshold = w.parallel.threshold
+		pw.BlockSize = w.parallel.blockSize
+		pw.Workers = w.parallel.workers
+		w.gw, w.poolMiss = pw, miss
+	}
+	w.gw.Reset(&w.cw)
+}
+
+// output writes p to the client, compressing it if a gzip.Writer is
+// in use.
+func (w *gzipResponseWriter) output(p []byte) (int, error) {
+	if w.discard || w.noBody {
+		return len(p), nil
+	}
+	if w.gw == nil {
+		n, err := w.cw.Write(p)
+		if err != nil {
+			w.fail(&Error{Err: err})
+		}
+		return n, err
+	}
+	if w.compressorFailed() {
+		return 0, w.failed
+	}
+	var n int
+	var err error
+	if !w.cw.timed {
+		n, err = w.gw.Write(p)
+	} else {
+		t, d := time.Now(), w.cw.d
+		n, err = w.gw.Write(p)
+		w.ctime += time.Since(t) - (w.cw.d - d)
+	}
+	if err != nil {
+		w.fail(&Error{Compressor: w.cw.err == nil, Err: err})
+		return n, err
+	}
+	if err = w.checkHeld(); err != nil {
+		w.fail(&Error{Err: err})
+	}
+	return n, err
+}
+
+// checkHeld gets called after compressed output is written, and calls
+// flushHeld if too many bytes are held.
+func (w *gzipResponseWriter) checkHeld() error {
+	if w.out == nil || w.bufferLimit <= 0 ||
+		int64(w.out.Len()) <= w.bufferLimit {
+		return nil
+	}
+	return w.flushHeld()
+}
+
+// bodyAllowed reports whether the response may have a body, which it
+// may not if the request's method is HEAD or the response's status
+// is 1xx, 204 No Content or 304 Not Modified.
+func (w *gzipResponseWriter) bodyAllowed() bool {
+	return w.req.Method != "HEAD" && bodyAllowedForStatus(w.httpStatus)
+}
+
+// bodyAllowedForStatus reports whether a response with the given
+// status may have a body.
+//
+// ref: https://www.rfc-editor.org/rfc/rfc9110#section-6.4.1
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent:
+		return false
+	case status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
 func (w *gzipResponseWriter) WriteHeader(httpStatus int) {
 	// postpone WriteHeader call until end of init method
 	w.httpStatus = httpStatus
 }
 
+// closeGzip writes any HTML padding, then closes the compressor in use
+// and returns it to its pool. A compressor which has returned an error
+// is neither closed nor pooled.
+func (w *gzipResponseWriter) closeGzip() error {
+	var err error
+	if !w.compressorFailed() {
+		err = w.writeHTMLPadding()
+	}
+	if !w.compressorFailed() {
+		t, d := time.Now(), w.cw.d
+		if e := w.gw.Close(); e != nil {
+			w.fail(&Error{Compressor: w.cw.err == nil, Err: e})
+			if err == nil {
+				err = e
+			}
+		}
+		if w.cw.timed {
+			w.ctime += time.Since(t) - (w.cw.d - d)
+		}
+	}
+	if w.gwPool != "" && !w.compressorFailed() {
+		w.pool.put(w.gwPool, w.level, w.gw)
+	}
+	w.gw = nil
+	if w.adapting {
+		w.adaptive.release(w.ctime)
+		w.adapting = false
+	}
+	w.releaseCompressor()
+	return err
+}
+
 func (w *gzipResponseWriter) Close() (err error) {
+	w.closing = true
+	var held bool // whether the whole compressed response was held
+	if w.dec != nil {
+		// w.dec is cleared first, so that abandon does not close
+		// it again if Close passes on a panic
+		dec := w.dec
+		w.dec = nil
+		if err = dec.Close(); err != nil {
+			w.fail(&Error{Decoder: true, Err: err})
+		}
+	}
+	if w.failed != nil && w.failed.Decoder {
+		// the response is incomplete, so must not be ended as if
+		// it were complete
+		w.abandon()
+		abort()
+	}
 	if w.buf != nil {
+		// the whole response is buffered
 		w.init()
 		p := w.buf.Bytes()
 		defer func() {
@@ -248,19 +728,61 @@ func (w *gzipResponseWriter) Close() (err error) {
 			w.buf = nil
 		}()
 		switch {
-		case w.gw != nil:
-			_, err = w.gw.Write(p)
+		case w.gw == nil:
+			if w.cw.h != nil {
+				// the content is p, so its digests can be sent
+				// as headers
+				_, _ = w.cw.h.Write(p)
+				w.cw.h = nil
+			}
+			w.setDigests("")
+			w.ResponseWriter.WriteHeader(w.httpStatus)
+		case w.bufferLimit > 0 || w.serverTiming || w.debug ||
+			w.digest != nil:
+			// the compressed response is held so that headers
+			// depending on it can be set
+			w.holdOutput()
 		default:
-			_, err = w.ResponseWriter.Write(p)
+			w.ResponseWriter.WriteHeader(w.httpStatus)
+		}
+		if _, e := w.output(p); e != nil && err == nil {
+			err = e
 		}
 	}
 	if w.gw != nil {
-		e := w.gw.Close()
-		if e != nil && err == nil {
+		if e := w.closeGzip(); e != nil && err == nil {
 			err = e
 		}
-		gzipWriterPools[w.level].Put(w.gw)
-		w.gw = nil
+	}
+	if w.out != nil && w.compressorFailed() {
+		// the response is incomplete and will be aborted
+		gzipBufPool.Put(w.out)
+		w.out = nil
+	}
+	if w.out != nil {
+		held = true
+		if e := w.writeHeld(); e != nil {
+			w.fail(&Error{Err: e})
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	if w.serverTiming && w.skip == NotSkipped && !held && !w.noBody {
+		w.Header().Add(http.TrailerPrefix+"Server-Timing", w.timing())
+	}
+	if w.debug {
+		w.setDebugTrailers()
+	}
+	w.setDigests(http.TrailerPrefix)
+	if w.dicts != nil {
+		w.storeDictionary()
+	}
+	if w.obs != nil {
+		w.obs.Observe(w.req, w.stats())
+	}
+	if w.compressorFailed() && w.failed.Op == "close" {
+		abort()
 	}
 	return err
 }
@@ -273,23 +795,21 @@ const (
 	encGzip
 )
 
-// acceptedEncodings returns the supported content codings that are
-// accepted by the request r. It returns a slice of encodings in
-// client preference order.
-//
-// If the Sec-WebSocket-Key header is present then compressed content
-// encodings are not considered.
+func (e encoding) String() string {
+	if e == encGzip {
+		return "gzip"
+	}
+	return "identity"
+}
+
+// parseAcceptEncoding returns the q-value of each content coding
+// listed in the Accept-Encoding header value h. Coding names are
+// lower-cased and if a coding is listed more than once its highest
+// q-value is returned.
 //
 // ref: http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html
-func acceptedEncodings(r *http.Request) []encoding {
-	h := r.Header.Get("Accept-Encoding")
-	swk := r.Header.Get("Sec-WebSocket-Key")
-	if h == "" {
-		return []encoding{encIdentity}
-	}
-	gzip := float64(-1)     // q-value: -1 means "not present in header"
-	identity := float64(-1) // q-value: -1 means "not present in header"
-	any := float64(-1)      // q-value: -1 means "not present in header"
+func parseAcceptEncoding(h string) map[string]float64 {
+	qs := map[string]float64{}
 	for _, s := range strings.Split(h, ",") {
 		f := strings.Split(s, ";")
 		f0 := strings.ToLower(strings.Trim(f[0], " "))
@@ -304,16 +824,58 @@ func acceptedEncodings(r *http.Request) []encoding {
 				}
 			}
 		}
-		if f0 == "gzip" && q > gzip && swk == "" {
-			gzip = q
+		if old, ok := qs[f0]; !ok || q > old {
+			qs[f0] = q
 		}
-		if f0 == "identity" && q > identity {
-			identity = q
+	}
+	return qs
+}
+
+// codingAccepted returns true if the content coding c is acceptable
+// according to the q-values qs returned by parseAcceptEncoding. The
+// coding "x-gzip" is treated as "gzip".
+func codingAccepted(qs map[string]float64, c string) bool {
+	q, ok := qs[c]
+	if !ok && (c == "gzip" || c == "x-gzip") {
+		q, ok = qs["x-gzip"]
+		if !ok {
+			q, ok = qs["gzip"]
 		}
-		if f0 == "*" && q > any {
-			any = q
+	}
+	if !ok {
+		q, ok = qs["*"]
+	}
+	return ok && q > 0
+}
+
+// acceptedEncodings returns the supported content codings that are
+// accepted by the request r. It returns a slice of encodings in
+// client preference order.
+//
+// If the Sec-WebSocket-Key header is present then compressed content
+// encodings are not considered.
+//
+// ref: http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html
+func acceptedEncodings(r *http.Request) []encoding {
+	h := r.Header.Get("Accept-Encoding")
+	swk := r.Header.Get("Sec-WebSocket-Key")
+	if h == "" {
+		return []encoding{encIdentity}
+	}
+	qs := parseAcceptEncoding(h)
+	// q-values: -1 means "not present in header"
+	qvalue := func(c string) float64 {
+		if q, ok := qs[c]; ok {
+			return q
 		}
+		return -1
+	}
+	gzip := float64(-1)
+	if swk == "" {
+		gzip = qvalue("gzip")
 	}
+	identity := qvalue("identity")
+	any := qvalue("*")
 	if identity == -1 {
 		if any >= 0 {
 			identity = any
@@ -354,6 +916,10 @@ func acceptedEncodings(r *http.Request) []encoding {
 // Accept-Ranges headers are stripped from corresponding
 // responses. This happens regardless of whether gzip encoding is
 // eventually used in the response or not.
+//
+// If h panics, the new http.Handler writes nothing more to the
+// response, so that a partly written compressed response is not
+// ended as if it were complete, and then panics with the same value.
 func NewHandler(h http.Handler, contentTypes []string) http.Handler {
 	gzh, _ := NewHandlerLevel(h, contentTypes, DefaultCompression)
 	return gzh
@@ -366,13 +932,277 @@ func NewHandler(h http.Handler, contentTypes []string) http.Handler {
 // any integer value between BestSpeed and BestCompression
 // inclusive. The error returned will be nil if the level is valid.
 func NewHandlerLevel(h http.Handler, contentTypes []string, level int) (http.Handler, error) {
+	return NewHandlerConfig(h, contentTypes, level, nil)
+}
+
+// A Config specifies optional behaviour of the http.Handler returned
+// by NewHandlerConfig. The zero value specifies the behaviour of
+// NewHandlerLevel.
+type Config struct {
+	// Transcode, if true, makes the handler ensure that responses
+	// the wrapped handler has already encoded (by setting a
+	// Content-Encoding header) satisfy the request's
+	// Accept-Encoding header. Such responses are passed through
+	// untouched if the client accepts their content codings, and
+	// otherwise decoded and then gzip compressed or sent with
+	// identity encoding as if the wrapped handler had written them
+	// unencoded, or replaced by a 406 Not Acceptable response if
+	// they cannot be decoded. See NewProxyHandler for details. If
+	// Transcode is false encoded responses are always passed
+	// through untouched.
+	Transcode bool
+
+	// Observer, if not nil, is passed statistics about every
+	// response once it has been written, including responses to
+	// requests which do not prefer gzip encoding.
+	Observer Observer
+
+	// Logger, if not nil, is used to log at debug level how the
+	// handler decided whether to compress each response: the
+	// request's Accept-Encoding header, the negotiated encodings,
+	// the response's content type, the number of bytes buffered
+	// when the decision was made and the verdict. It is also used
+	// to log errors writing responses: at error level if the
+	// compressor or decoder failed, and at debug level otherwise.
+	Logger *slog.Logger
+
+	// OnError, if not nil, is called with an *Error if writing a
+	// response fails, because the compressor, the decoder used by
+	// Transcode or the underlying http.ResponseWriter returned an
+	// error. It is called at most once per response, during a call
+	// to the ResponseWriter's Write method or once the wrapped
+	// handler has returned. If the compressor or decoder failed,
+	// the handler then aborts the response by panicking with
+	// http.ErrAbortHandler on the handler's goroutine, so that the
+	// client does not receive a truncated response which looks
+	// complete. This happens whether or not OnError is set.
+	OnError func(r *http.Request, err error)
+
+	// ServerTiming, if true, makes the handler add a Server-Timing
+	// metric named gzip to compressed responses, giving the time
+	// spent compressing in milliseconds, for example
+	// "gzip;dur=0.153". It is sent as a header if the whole
+	// response was buffered before the response headers were
+	// written, and as a trailer otherwise.
+	ServerTiming bool
+
+	// Levels, if not nil, maps media types to the compression level
+	// to use for responses of that type instead of the handler's
+	// level. A media type may be an exact type such as
+	// "application/json", or use a wildcard as in "text/*" or
+	// "*/*". The most specific match is used.
+	Levels map[string]int
+
+	// Adaptive, if not nil, lowers the compression level used while
+	// the handler is under CPU pressure.
+	Adaptive *AdaptiveLevel
+
+	// MaxCompressors, if positive, limits the number of responses
+	// the handler compresses concurrently. When the limit is
+	// reached, responses to requests which accept identity encoding
+	// are sent without compression. Other requests wait up to
+	// CompressorWait for a response to finish compressing, and are
+	// answered with 503 Service Unavailable status if none does.
+	MaxCompressors int
+	CompressorWait time.Duration
+
+	// Debug, if true, makes the handler add headers explaining its
+	// compression decision to every response. DebugHeader, if not
+	// empty, is the name of a request header whose presence makes
+	// the handler add them to that request's response only. See
+	// the package documentation for the headers added.
+	Debug       bool
+	DebugHeader string
+
+	// Pool, if not nil, holds idle compressors for reuse by the
+	// handler instead of DefaultEncoderPool.
+	Pool *EncoderPool
+
+	// ParallelThreshold, if positive, makes the handler compress
+	// the part of each response after its first ParallelThreshold
+	// bytes using several goroutines. That part is split into
+	// blocks of ParallelBlockSize bytes (1MB if zero), each
+	// compressed independently, but using the end of the previous
+	// block as a dictionary, by one of up to ParallelWorkers
+	// goroutines (GOMAXPROCS if zero). The blocks are joined to
+	// form a standard gzip stream, a little larger than if it had
+	// been compressed by one goroutine. This is only worthwhile for
+	// very large responses, so ParallelThreshold should be several
+	// times ParallelBlockSize. Parallel compression always uses the
+	// standard library compress/flate package.
+	ParallelThreshold int64
+	ParallelBlockSize int
+	ParallelWorkers   int
+
+	// MinSaving, if positive, makes the handler estimate how much
+	// compression would save from the entropy of the start of each
+	// response, and skip compressing responses for which the
+	// expected saving, as a fraction of the response's size, is
+	// below MinSaving. This avoids wasting time compressing data
+	// which is already compressed, such as base64 encoded images in
+	// JSON or binaries labelled with a text content type. The
+	// estimate is conservative for text, which is typically
+	// expected to save around 0.4. A MinSaving of 0.1 skips data
+	// which is already compressed, and 0.3 also skips base64
+	// encoded compressed data. It must be less than 1.
+	MinSaving float64
+
+	// Breach, if not nil, enables mitigations against the BREACH
+	// attack.
+	Breach *BreachMitigation
+
+	// Dictionaries, if not nil, enables Compression Dictionary
+	// Transport.
+	Dictionaries *DictionaryTransport
+
+	// Preset, if not nil, is a preset DEFLATE dictionary used to
+	// compress responses to requests which accept its content
+	// coding, instead of gzip. It is only used for responses which
+	// would otherwise be gzip compressed, so the request must also
+	// accept gzip and prefer it to identity encoding, as in
+	// "Accept-Encoding: gzip, x-deflate-dict".
+	Preset *PresetDictionary
+
+	// TransferCoding, if true, makes the handler compress responses
+	// to HTTP/1.1 requests whose TE header accepts gzip using the
+	// gzip transfer coding, sending "Transfer-Encoding: gzip,
+	// chunked" instead of a Content-Encoding header. The response
+	// is then unchanged end to end, so its ETag and any Range
+	// request stay valid. The decision whether to compress is made
+	// as for the content coding, and the content coding is still
+	// used for requests which do not accept identity encoding.
+	TransferCoding bool
+
+	// GzipHeader, if not nil, is called with the request and the
+	// response's header when a response is about to be gzip
+	// compressed, and returns the metadata to write in the gzip
+	// header. Otherwise the gzip header is empty. FileGzipHeader
+	// is suitable for responses which are downloaded as files.
+	GzipHeader func(r *http.Request, h http.Header) GzipHeader
+
+	// Digests, if not nil, makes the handler send Content-Digest
+	// and Repr-Digest fields with responses.
+	Digests *Digests
+
+	// BufferLimit, if positive, makes the handler hold back the
+	// output of each compressed response until the whole response
+	// has been compressed, so that an accurate Content-Length
+	// header can be sent, as long as the compressed response is at
+	// most BufferLimit bytes. Once more than BufferLimit compressed
+	// bytes are held, they are sent and the rest of the response is
+	// streamed as usual. Responses using the gzip transfer coding,
+	// and responses which have no body, such as those to HEAD
+	// requests, are never sent with a Content-Length header by the
+	// handler.
+	BufferLimit int64
+}
+
+// checkLevel returns an error if level is not a valid compression
+// level.
+func checkLevel(level int) error {
 	switch {
 	case level == DefaultCompression || level == NoCompression:
 		// no action needed
 	case level < BestSpeed || level > BestCompression:
-		return nil, fmt.Errorf(
+		return fmt.Errorf(
 			"httpgzip: invalid compression level: %d", level)
 	}
+	return nil
+}
+
+// mediaTypeLevel returns the compression level in levels for the
+// media type mt and whether there is one. An exact match is
+// preferred, then a match for the wildcard subtype ("text/*"), then
+// for the wildcard type ("*/*").
+func mediaTypeLevel(levels map[string]int, mt string) (int, bool) {
+	if len(levels) == 0 {
+		return 0, false
+	}
+	if level, ok := levels[mt]; ok {
+		return level, true
+	}
+	if i := strings.IndexByte(mt, '/'); i >= 0 {
+		if level, ok := levels[mt[:i]+"/*"]; ok {
+			return level, true
+		}
+	}
+	level, ok := levels["*/*"]
+	return level, ok
+}
+
+// NewHandlerConfig is like NewHandlerLevel but also takes a Config
+// specifying optional behaviour. A nil Config is equivalent to a
+// zero Config.
+func NewHandlerConfig(h http.Handler, contentTypes []string, level int, c *Config) (http.Handler, error) {
+	var cfg Config
+	if c != nil {
+		cfg = *c
+	}
+	if err := checkLevel(level); err != nil {
+		return nil, err
+	}
+	levels := map[string]int{}
+	for mt, level := range cfg.Levels {
+		if err := checkLevel(level); err != nil {
+			return nil, err
+		}
+		levels[strings.ToLower(mt)] = level
+	}
+	if cfg.Adaptive != nil {
+		if err := cfg.Adaptive.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ParallelThreshold < 0 || cfg.ParallelBlockSize < 0 ||
+		cfg.ParallelWorkers < 0 {
+		return nil, fmt.Errorf(
+			"httpgzip: invalid parallel compression settings: %d, %d, %d",
+			cfg.ParallelThreshold, cfg.ParallelBlockSize,
+			cfg.ParallelWorkers)
+	}
+	if err := checkMinSaving(cfg.MinSaving); err != nil {
+		return nil, err
+	}
+	if cfg.BufferLimit < 0 {
+		return nil, fmt.Errorf(
+			"httpgzip: invalid buffer limit: %d", cfg.BufferLimit)
+	}
+	if cfg.Breach != nil {
+		if err := cfg.Breach.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Dictionaries != nil {
+		if err := cfg.Dictionaries.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Digests != nil {
+		if err := cfg.Digests.validate(); err != nil {
+			return nil, err
+		}
+	}
+	var preset *PresetDictionary
+	if cfg.Preset != nil {
+		p := *cfg.Preset
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		preset = &p
+	}
+	parallel := parallelConfig{
+		threshold: cfg.ParallelThreshold,
+		blockSize: cfg.ParallelBlockSize,
+		workers:   cfg.ParallelWorkers,
+	}
+	pool := cfg.Pool
+	if pool == nil {
+		pool = DefaultEncoderPool
+	}
+	var sem chan struct{}
+	if cfg.MaxCompressors > 0 {
+		sem = make(chan struct{}, cfg.MaxCompressors)
+	}
 	if contentTypes == nil {
 		contentTypes = DefaultContentTypes
 	}
@@ -380,23 +1210,94 @@ func NewHandlerLevel(h http.Handler, contentTypes []string, level int) (http.Han
 	for _, ct := range contentTypes {
 		ctMap[ct] = struct{}{}
 	}
+	// whether responses to requests not preferring gzip encoding
+	// need a gzipResponseWriter
+	wrapAll := cfg.Transcode || cfg.Observer != nil ||
+		cfg.Logger != nil || cfg.Debug || cfg.DebugHeader != "" ||
+		cfg.Dictionaries != nil || cfg.Digests != nil || cfg.OnError != nil
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// add Vary header
 		w.Header().Add("Vary", "Accept-Encoding")
+		if cfg.Dictionaries != nil {
+			w.Header().Add("Vary", "Available-Dictionary")
+		}
 		// check client's accepted encodings
 		encs := acceptedEncodings(r)
 		// return if no acceptable encodings
 		if len(encs) == 0 {
+			if cfg.Logger != nil {
+				logNotAcceptable(cfg.Logger, r)
+			}
+			if cfg.debug(r) {
+				w.Header().Set(decisionHeader,
+					"none; reason="+SkipNotAcceptable.String())
+			}
 			w.WriteHeader(http.StatusNotAcceptable)
+			if cfg.Observer != nil {
+				cfg.Observer.Observe(r, Stats{Skip: SkipNotAcceptable})
+			}
 			return
 		}
-		if encs[0] == encGzip {
-			// cannot accept Range requests for possibly gzipped
-			// responses
-			r.Header.Del("Range")
+		te := cfg.TransferCoding && acceptsGzipTransfer(r, encs)
+		if encs[0] == encGzip || wrapAll || te {
+			if encs[0] == encGzip && !te {
+				// cannot accept Range requests for possibly
+				// gzipped responses
+				r.Header.Del("Range")
+			}
 			// create new ResponseWriter
-			w = newGzipResponseWriter(w, ctMap, encs, level)
-			defer w.(*gzipResponseWriter).Close()
+			gzw := newGzipResponseWriter(w, ctMap, encs, level)
+			gzw.req = r
+			gzw.pool = pool
+			gzw.parallel = parallel
+			gzw.minSaving = cfg.MinSaving
+			gzw.breach = cfg.Breach
+			gzw.te = te
+			gzw.headerFunc = cfg.GzipHeader
+			gzw.bufferLimit = cfg.BufferLimit
+			if cfg.Digests != nil {
+				gzw.digest = newDigester(cfg.Digests, r)
+				if gzw.digest != nil && !te {
+					gzw.cw.h = gzw.digest.writer()
+				}
+			}
+			gzw.preset = preset
+			if d := cfg.Dictionaries; d != nil {
+				gzw.dicts = d
+				if d.Advertise != nil {
+					if v := d.Advertise(r); v != "" {
+						w.Header().Set("Use-As-Dictionary", v)
+						gzw.dictBuf = new(bytes.Buffer)
+					}
+				}
+			}
+			if cfg.Transcode {
+				gzw.transcode = true
+				gzw.accept = parseAcceptEncoding(
+					r.Header.Get("Accept-Encoding"))
+			}
+			if cfg.Observer != nil {
+				gzw.obs = cfg.Observer
+				gzw.cw.timed = true
+			}
+			gzw.logger = cfg.Logger
+			gzw.onError = cfg.OnError
+			gzw.serverTiming = cfg.ServerTiming
+			gzw.levels = levels
+			gzw.adaptive = cfg.Adaptive
+			gzw.sem, gzw.semWait = sem, cfg.CompressorWait
+			if cfg.ServerTiming || cfg.Adaptive != nil {
+				gzw.cw.timed = true
+			}
+			gzw.debug = cfg.debug(r)
+			w = gzw
+			defer func() {
+				if p := recover(); p != nil {
+					gzw.abandon()
+					panic(p)
+				}
+				_ = gzw.Close()
+			}()
 		}
 		// call original handler's ServeHTTP
 		h.ServeHTTP(w, r)
@@ -6,11 +6,16 @@ package httpgzip_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -334,7 +339,15 @@ func isGzip(b []byte) bool {
 // added. getPath returns the http.Response (with Body closed) and the
 // result of reading the response Body.
 func getPath(t *testing.T, h http.Handler, level int, path string, headers []string) (*http.Response, []byte) {
-	gzh, _ := httpgzip.NewHandlerLevel(h, nil, level)
+	return getPathConfig(t, h, level, nil, path, headers)
+}
+
+// getPathConfig is like getPath but wraps h using the Config c.
+func getPathConfig(t *testing.T, h http.Handler, level int, c *httpgzip.Config, path string, headers []string) (*http.Response, []byte) {
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, level, c)
+	if err != nil {
+		t.Fatal(err)
+	}
 	ts := httptest.NewServer(gzh)
 	defer ts.Close()
 	req, err := http.NewRequest("GET", ts.URL+path, nil)
@@ -480,3 +493,204 @@ func TestCompressionLevels(t *testing.T) {
 		sizes[len(body)] = struct{}{}
 	}
 }
+
+// TestTranscode creates a handler serving a gzipped text file which
+// sets Content-Encoding, wraps it with httpgzip using a Config whose
+// Transcode field is true, and requests that file with various
+// Accept-Encoding headers. It checks that the response is decoded
+// when the client does not accept gzip and passed through otherwise.
+func TestTranscode(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, _ = gw.Write(data)
+	_ = gw.Close()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		_, _ = w.Write(buf.Bytes())
+	})
+	c := &httpgzip.Config{Transcode: true}
+	for _, tc := range []struct {
+		c          *httpgzip.Config
+		reqHeaders []string
+		resGzip    bool
+	}{
+		{c, []string{"Accept-Encoding: gzip"}, true},
+		{c, []string{"Accept-Encoding: gzip;q=0"}, false},
+		{c, []string{"Accept-Encoding: identity"}, false},
+		{c, nil, false},
+		{nil, []string{"Accept-Encoding: gzip;q=0"}, true},
+	} {
+		res, body := getPathConfig(t, h, defComp, tc.c, "/", tc.reqHeaders)
+		if isGzip(body) != tc.resGzip {
+			t.Fatalf(
+				"\nrequest headers %v, expected gzip status %v, got %v\n",
+				tc.reqHeaders, tc.resGzip, isGzip(body))
+		}
+		if !tc.resGzip && (!bytes.Equal(body, data) ||
+			res.Header.Get("Content-Encoding") != "") {
+			t.Fatalf(
+				"\nrequest headers %v, expected decoded response\n",
+				tc.reqHeaders)
+		}
+	}
+}
+
+// TestServerTiming requests files from an http.FileServer wrapped
+// with a Config whose ServerTiming field is true, and checks that
+// compressed responses have a Server-Timing header or trailer.
+func TestServerTiming(t *testing.T) {
+	h := http.FileServer(http.Dir("testdata"))
+	c := &httpgzip.Config{ServerTiming: true}
+	timing := regexp.MustCompile(`^gzip;dur=[0-9]+\.[0-9]{3}$`)
+	for _, tc := range []struct {
+		reqFile    string
+		reqHeaders []string
+		header     bool
+		trailer    bool
+	}{
+		{"4096bytes.txt", []string{"Accept-Encoding: gzip"}, false, true},
+		{"511bytes.txt", []string{"Accept-Encoding: gzip;q=1,identity;q=0"},
+			true, false},
+		{"511bytes.txt", []string{"Accept-Encoding: gzip"}, false, false},
+		{"4096bytes.txt", nil, false, false},
+	} {
+		res, _ := getPathConfig(
+			t, h, defComp, c, "/"+tc.reqFile, tc.reqHeaders)
+		header := res.Header.Get("Server-Timing")
+		trailer := res.Trailer.Get("Server-Timing")
+		if tc.header != timing.MatchString(header) ||
+			tc.trailer != timing.MatchString(trailer) ||
+			!tc.header && header != "" || !tc.trailer && trailer != "" {
+			t.Fatalf(
+				"\nfile %s, request headers %v\n"+
+					"unexpected Server-Timing header %q, trailer %q\n",
+				tc.reqFile, tc.reqHeaders, header, trailer)
+		}
+	}
+}
+
+// TestContentTypeLevels serves a text file with various content
+// types using a Config whose Levels field maps media types to
+// compression levels, and checks the level used for each.
+func TestContentTypeLevels(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		_, _ = w.Write(data)
+	})
+	levelc := make(chan int, 1)
+	c := &httpgzip.Config{
+		Levels: map[string]int{
+			"application/json": httpgzip.BestSpeed,
+			"text/*":           httpgzip.BestCompression,
+			"Text/CSS":         4,
+		},
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				levelc <- s.Level
+			}),
+	}
+	for _, tc := range []struct {
+		ct    string
+		level int
+	}{
+		{"application/json", httpgzip.BestSpeed},
+		{"text/html; charset=utf-8", httpgzip.BestCompression},
+		{"text/css", 4},
+		{"application/xml", 2},
+	} {
+		_, body := getPathConfig(t, h, 2, c,
+			"/?ct="+url.QueryEscape(tc.ct), []string{"Accept-Encoding: gzip"})
+		if !isGzip(body) {
+			t.Fatalf("\ncontent type %s, expected gzipped body\n", tc.ct)
+		}
+		if level := <-levelc; level != tc.level {
+			t.Fatalf(
+				"\ncontent type %s, expected level %d, got %d\n",
+				tc.ct, tc.level, level)
+		}
+	}
+	c = &httpgzip.Config{Levels: map[string]int{"text/*": 42}}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for invalid level\n")
+	}
+}
+
+// TestParallel checks that responses of various sizes, written in
+// chunks of various sizes, are compressed to a single member gzip
+// stream when parallel compression is enabled.
+func TestParallel(t *testing.T) {
+	var data bytes.Buffer
+	for i := 0; data.Len() < 3<<20; i++ {
+		data.WriteString(strconv.Itoa(i * i % 7919))
+		data.WriteString(" bottles of beer on the wall\n")
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		chunk, _ := strconv.Atoi(r.URL.Query().Get("chunk"))
+		p := data.Bytes()[:n]
+		for len(p) > 0 {
+			m := chunk
+			if m > len(p) {
+				m = len(p)
+			}
+			_, _ = w.Write(p[:m])
+			p = p[m:]
+		}
+	})
+	c := &httpgzip.Config{
+		ParallelThreshold: 100 << 10,
+		ParallelBlockSize: 64 << 10,
+		ParallelWorkers:   3,
+	}
+	for _, tc := range []struct {
+		n, chunk int
+	}{
+		{4096, 4096},
+		{100 << 10, 1000},
+		{200 << 10, 4096},
+		{300 << 10, 100 << 10},
+		{100<<10 + 1, 100<<10 + 1},
+		{164 << 10, 64 << 10},
+		{1 << 20, 12345},
+		{data.Len(), data.Len()},
+	} {
+		for _, level := range []int{defComp, httpgzip.BestSpeed,
+			httpgzip.NoCompression} {
+			_, body := getPathConfig(t, h, level, c,
+				fmt.Sprintf("/?n=%d&chunk=%d", tc.n, tc.chunk),
+				[]string{"Accept-Encoding: gzip"})
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			zr.Multistream(false)
+			got, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("\nsize %d, level %d\n%v\n", tc.n, level, err)
+			}
+			if !bytes.Equal(got, data.Bytes()[:tc.n]) {
+				t.Fatalf("\nsize %d, level %d\nbody differs\n",
+					tc.n, level)
+			}
+			if _, err := zr.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("\nsize %d, level %d\nexpected EOF, got %v\n",
+					tc.n, level, err)
+			}
+		}
+	}
+	c = &httpgzip.Config{ParallelWorkers: -1}
+	if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+		t.Fatalf("\nexpected error for invalid parallel settings\n")
+	}
+}
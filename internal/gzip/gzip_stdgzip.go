@@ -21,6 +21,8 @@ const (
 	DefaultCompression = gzip.DefaultCompression
 )
 
+type Header gzip.Header
+
 type Writer gzip.Writer
 
 func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
@@ -32,6 +34,10 @@ func (z *Writer) Reset(w io.Writer) {
 	(*gzip.Writer)(z).Reset(w)
 }
 
+func (z *Writer) SetHeader(h Header) {
+	(*gzip.Writer)(z).Header = gzip.Header(h)
+}
+
 func (z *Writer) Write(p []byte) (int, error) {
 	return (*gzip.Writer)(z).Write(p)
 }
@@ -39,3 +45,18 @@ func (z *Writer) Write(p []byte) (int, error) {
 func (z *Writer) Close() error {
 	return (*gzip.Writer)(z).Close()
 }
+
+type Reader gzip.Reader
+
+func NewReader(r io.Reader) (*Reader, error) {
+	z, err := gzip.NewReader(r)
+	return (*Reader)(z), err
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	return (*gzip.Reader)(z).Read(p)
+}
+
+func (z *Reader) Close() error {
+	return (*gzip.Reader)(z).Close()
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+// Package pgzip implements a gzip writer which compresses large
+// streams using several goroutines, in the manner of pigz. It always
+// uses the standard library compress/flate package.
+package pgzip
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"time"
+)
+
+const (
+	// DefaultBlockSize is the block size used if BlockSize is not
+	// positive.
+	DefaultBlockSize = 1 << 20
+	// dictSize is the size of the DEFLATE window, and so of the
+	// dictionary each block is primed with.
+	dictSize = 32 << 10
+)
+
+// A Header is the gzip header written by a Writer. It has the same
+// fields as compress/gzip.Header.
+type Header struct {
+	Comment string
+	Extra   []byte
+	ModTime time.Time
+	Name    string
+	OS      byte
+}
+
+// A Writer is an io.WriteCloser which writes a single member gzip
+// stream. The first Threshold bytes written are compressed in the
+// calling goroutine. After that the data is split into blocks of
+// BlockSize bytes which are compressed concurrently by up to Workers
+// goroutines, each block using the last 32KB of the previous one as
+// its dictionary, and ending with a sync flush so that the compressed
+// blocks can be concatenated. Output is only ever written to the
+// underlying io.Writer from the calling goroutine.
+//
+// Header, Threshold, BlockSize and Workers must be set before the
+// first call to Write. If Workers is not positive,
+// runtime.GOMAXPROCS(0) is used.
+type Writer struct {
+	Header
+	Threshold int64
+	BlockSize int
+	Workers   int
+
+	w       io.Writer
+	level   int
+	fw      *flate.Writer // compresses the first Threshold bytes
+	started bool          // whether the header has been written
+	crc     uint32
+	size    int64    // bytes written
+	hist    []byte   // last dictSize bytes compressed by fw
+	block   []byte   // data for the next parallel block
+	dict    []byte   // dictionary for the next parallel block
+	pending []*block // blocks being compressed, in order
+	err     error
+}
+
+// A block is a block of data being compressed by a goroutine.
+type block struct {
+	done chan struct{}
+	out  bytes.Buffer
+	err  error
+}
+
+// NewWriterLevel returns a new Writer writing to w which compresses
+// using the given level, as for compress/flate.
+func NewWriterLevel(w io.Writer, level int) (*Writer, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("pgzip: invalid compression level: %d", level)
+	}
+	return &Writer{Header: Header{OS: 255}, w: w, level: level}, nil
+}
+
+// Reset discards z's state and makes it equivalent to the result of
+// NewWriterLevel with the same level but writing to w. The Threshold,
+// BlockSize and Workers fields are left unchanged.
+func (z *Writer) Reset(w io.Writer) {
+	*z = Writer{
+		Header:    Header{OS: 255},
+		Threshold: z.Threshold,
+		BlockSize: z.BlockSize,
+		Workers:   z.Workers,
+		w:         w,
+		level:     z.level,
+		fw:        z.fw,
+		hist:      z.hist[:0],
+	}
+}
+
+// latin1 returns s encoded as ISO 8859-1 and terminated by a zero
+// byte, as required for the gzip header's Name and Comment fields.
+func latin1(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s)+1)
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			return nil, errors.New("pgzip: non-Latin-1 header string")
+		}
+		b = append(b, byte(r))
+	}
+	return append(b, 0), nil
+}
+
+// writeHeader writes the gzip header.
+func (z *Writer) writeHeader() error {
+	z.started = true
+	hdr := make([]byte, 10, 16)
+	hdr[0], hdr[1], hdr[2], hdr[9] = 0x1f, 0x8b, 8, z.OS
+	if z.ModTime.After(time.Unix(0, 0)) {
+		binary.LittleEndian.PutUint32(hdr[4:8], uint32(z.ModTime.Unix()))
+	}
+	switch z.level {
+	case flate.BestCompression:
+		hdr[8] = 2
+	case flate.BestSpeed:
+		hdr[8] = 4
+	}
+	if z.Extra != nil {
+		if len(z.Extra) > 0xffff {
+			return errors.New("pgzip: extra data is too large")
+		}
+		hdr[3] |= 1 << 2
+		hdr = binary.LittleEndian.AppendUint16(hdr, uint16(len(z.Extra)))
+		hdr = append(hdr, z.Extra...)
+	}
+	if z.Name != "" {
+		b, err := latin1(z.Name)
+		if err != nil {
+			return err
+		}
+		hdr[3] |= 1 << 3
+		hdr = append(hdr, b...)
+	}
+	if z.Comment != "" {
+		b, err := latin1(z.Comment)
+		if err != nil {
+			return err
+		}
+		hdr[3] |= 1 << 4
+		hdr = append(hdr, b...)
+	}
+	_, err := z.w.Write(hdr)
+	return err
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if !z.started {
+		if z.err = z.writeHeader(); z.err != nil {
+			return 0, z.err
+		}
+	}
+	n := len(p)
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, p)
+	if serial := z.Threshold - z.size; serial > 0 {
+		if serial > int64(len(p)) {
+			serial = int64(len(p))
+		}
+		if z.err = z.writeSerial(p[:serial]); z.err != nil {
+			return 0, z.err
+		}
+		p = p[serial:]
+		z.size += serial
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if z.Threshold > 0 && z.size == z.Threshold {
+		// switch to parallel compression, ending fw's output on
+		// a byte boundary; this happens once, since z.size then
+		// exceeds z.Threshold
+		if z.err = z.fw.Flush(); z.err != nil {
+			return 0, z.err
+		}
+		z.dict = z.hist
+		z.hist = nil
+	}
+	z.size += int64(len(p))
+	bs := z.BlockSize
+	if bs <= 0 {
+		bs = DefaultBlockSize
+	}
+	for len(p) > 0 {
+		if z.block == nil {
+			z.block = make([]byte, 0, bs)
+		}
+		m := copy(z.block[len(z.block):bs], p)
+		z.block = z.block[:len(z.block)+m]
+		p = p[m:]
+		if len(z.block) == bs {
+			if z.err = z.dispatch(); z.err != nil {
+				return 0, z.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeSerial compresses p using fw, keeping the last dictSize bytes
+// in hist.
+func (z *Writer) writeSerial(p []byte) error {
+	if z.fw == nil {
+		fw, err := flate.NewWriter(z.w, z.level)
+		if err != nil {
+			return err
+		}
+		z.fw = fw
+	} else if z.size == 0 {
+		z.fw.Reset(z.w)
+	}
+	if len(p) >= dictSize {
+		z.hist = append(z.hist[:0], p[len(p)-dictSize:]...)
+	} else {
+		z.hist = append(z.hist, p...)
+		if len(z.hist) > dictSize {
+			z.hist = append(z.hist[:0], z.hist[len(z.hist)-dictSize:]...)
+		}
+	}
+	_, err := z.fw.Write(p)
+	return err
+}
+
+// dispatch starts compressing the current block in a new goroutine,
+// first waiting for the oldest pending block if Workers are busy.
+func (z *Writer) dispatch() error {
+	workers := z.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for len(z.pending) >= workers {
+		if err := z.writePending(); err != nil {
+			return err
+		}
+	}
+	b := &block{done: make(chan struct{})}
+	data, dict := z.block, z.dict
+	go func() {
+		defer close(b.done)
+		fw, err := flate.NewWriterDict(&b.out, z.level, dict)
+		if err == nil {
+			_, err = fw.Write(data)
+		}
+		if err == nil {
+			err = fw.Flush()
+		}
+		b.err = err
+	}()
+	z.pending = append(z.pending, b)
+	if len(data) >= dictSize {
+		z.dict = data[len(data)-dictSize:]
+	} else {
+		z.dict = append(append([]byte(nil), z.dict...), data...)
+		if len(z.dict) > dictSize {
+			z.dict = z.dict[len(z.dict)-dictSize:]
+		}
+	}
+	z.block = nil
+	return nil
+}
+
+// writePending waits for the oldest pending block and writes its
+// compressed data.
+func (z *Writer) writePending() error {
+	b := z.pending[0]
+	z.pending[0] = nil
+	z.pending = z.pending[1:]
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+	_, err := b.out.WriteTo(z.w)
+	return err
+}
+
+// Close finishes compressing the data written to z, waiting for all
+// blocks to be compressed, and writes the gzip trailer. It does not
+// close the underlying io.Writer.
+func (z *Writer) Close() error {
+	if z.err != nil {
+		z.wait()
+		return z.err
+	}
+	if !z.started {
+		if z.err = z.writeHeader(); z.err != nil {
+			return z.err
+		}
+	}
+	z.err = z.finish()
+	z.wait()
+	if z.err == nil {
+		var trailer [8]byte
+		binary.LittleEndian.PutUint32(trailer[:4], z.crc)
+		binary.LittleEndian.PutUint32(trailer[4:], uint32(z.size))
+		_, z.err = z.w.Write(trailer[:])
+	}
+	if z.err == nil {
+		// prevent further writes
+		z.err = io.ErrClosedPipe
+		return nil
+	}
+	return z.err
+}
+
+// finish ends the DEFLATE stream.
+func (z *Writer) finish() error {
+	if z.size <= z.Threshold {
+		// parallel compression was never started
+		if z.size == 0 {
+			if err := z.writeSerial(nil); err != nil {
+				return err
+			}
+		}
+		return z.fw.Close()
+	}
+	if len(z.block) > 0 {
+		if err := z.dispatch(); err != nil {
+			return err
+		}
+	}
+	for len(z.pending) > 0 {
+		if err := z.writePending(); err != nil {
+			return err
+		}
+	}
+	// an empty final block using fixed Huffman codes
+	_, err := z.w.Write([]byte{0x03, 0x00})
+	return err
+}
+
+// wait waits for any pending blocks to be compressed, discarding
+// them.
+func (z *Writer) wait() {
+	for _, b := range z.pending {
+		<-b.done
+	}
+	z.pending = nil
+}
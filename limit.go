@@ -0,0 +1,53 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"net/http"
+	"time"
+)
+
+// acquireCompressor gets called by init before compressing a response
+// when the handler limits the number of concurrent compressors. It
+// returns whether a slot in w.sem was acquired. If no slot is free it
+// only waits, for up to w.semWait, if the request does not accept
+// identity encoding.
+func (w *gzipResponseWriter) acquireCompressor() bool {
+	select {
+	case w.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if w.identityOK() || w.semWait <= 0 {
+		return false
+	}
+	t := time.NewTimer(w.semWait)
+	defer t.Stop()
+	select {
+	case w.sem <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-w.req.Context().Done():
+	}
+	return false
+}
+
+// releaseCompressor releases the slot in w.sem if one is held.
+func (w *gzipResponseWriter) releaseCompressor() {
+	if w.holdingSem {
+		<-w.sem
+		w.holdingSem = false
+	}
+}
+
+// unavailable gets called by init when a response which must be
+// compressed cannot be. It arranges for a 503 Service Unavailable
+// status to be sent instead, discarding the response body.
+func (w *gzipResponseWriter) unavailable() {
+	w.httpStatus = http.StatusServiceUnavailable
+	w.discard = true
+	w.Header().Del("Content-Type")
+	w.Header().Set("Content-Length", "0")
+}
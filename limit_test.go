@@ -0,0 +1,97 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestMaxCompressors holds one compressed response open while making
+// further requests to a handler whose Config has MaxCompressors 1. It
+// checks that responses fall back to identity encoding or 503 Service
+// Unavailable status while the response is open, and are compressed
+// again afterwards.
+func TestMaxCompressors(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+	})
+	statsc := make(chan httpgzip.Stats, 1)
+	c := &httpgzip.Config{
+		MaxCompressors: 1,
+		CompressorWait: 10 * time.Millisecond,
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				statsc <- s
+			}),
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gzh)
+	defer ts.Close()
+	get := func(path, acceptEncoding string) (int, http.Header) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := (&http.Transport{}).RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return 0, nil
+		}
+		_, _ = ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		return res.StatusCode, res.Header
+	}
+	go get("/block", "gzip")
+	<-started
+	for _, tc := range []struct {
+		acceptEncoding string
+		resCode        int
+		coding         string
+		skip           httpgzip.SkipReason
+	}{
+		{"gzip", http.StatusOK, "identity", httpgzip.SkipConcurrency},
+		{"gzip, identity;q=0", http.StatusServiceUnavailable,
+			"identity", httpgzip.SkipConcurrency},
+		{"identity", http.StatusOK, "identity", httpgzip.SkipClientRefused},
+	} {
+		code, header := get("/", tc.acceptEncoding)
+		s := <-statsc
+		if code != tc.resCode || s.Coding != tc.coding || s.Skip != tc.skip {
+			t.Fatalf(
+				"\nAccept-Encoding %s, unexpected status %d and stats %+v\n",
+				tc.acceptEncoding, code, s)
+		}
+		if code == http.StatusServiceUnavailable &&
+			header.Get("Content-Type") != "" {
+			t.Fatalf("\nunexpected Content-Type %q with empty 503\n",
+				header.Get("Content-Type"))
+		}
+	}
+	close(unblock)
+	<-statsc // stats of /block
+	code, _ := get("/", "gzip, identity;q=0")
+	if s := <-statsc; code != http.StatusOK || s.Coding != "gzip" {
+		t.Fatalf("\nunexpected status %d and stats %+v\n", code, s)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// logDecision logs the decision made by init to w.logger. It must be
+// called after init has set w.skip.
+func (w *gzipResponseWriter) logDecision() {
+	ctx := w.req.Context()
+	if !w.logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	encs := make([]string, len(w.encs))
+	for i, e := range w.encs {
+		encs[i] = e.String()
+	}
+	verdict := w.coding
+	if w.skip != NotSkipped {
+		verdict = "skip: " + w.skip.String()
+	}
+	w.logger.LogAttrs(ctx, slog.LevelDebug, "httpgzip: compression decision",
+		slog.String("method", w.req.Method),
+		slog.String("path", w.req.URL.Path),
+		slog.String("accept_encoding", w.req.Header.Get("Accept-Encoding")),
+		slog.String("encodings", strings.Join(encs, ",")),
+		slog.String("content_type", w.ct),
+		slog.Int("buffered", w.buf.Len()),
+		slog.String("verdict", verdict),
+	)
+}
+
+// logNotAcceptable logs to logger that a 406 Not Acceptable response
+// is being sent to the request r.
+func logNotAcceptable(logger *slog.Logger, r *http.Request) {
+	ctx := r.Context()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	logger.LogAttrs(ctx, slog.LevelDebug, "httpgzip: compression decision",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("accept_encoding", r.Header.Get("Accept-Encoding")),
+		slog.String("encodings", ""),
+		slog.String("verdict", "skip: "+SkipNotAcceptable.String()),
+	)
+}
+
+// logError logs the error w.failed to w.logger. Errors returned by
+// the compressor or decoder are logged at error level, while those
+// writing to the client, which usually mean it has gone away, are
+// logged at debug level.
+func (w *gzipResponseWriter) logError() {
+	ctx := w.req.Context()
+	level := slog.LevelDebug
+	if w.failed.kind() != "client" {
+		level = slog.LevelError
+	}
+	if !w.logger.Enabled(ctx, level) {
+		return
+	}
+	w.logger.LogAttrs(ctx, level, "httpgzip: writing response failed",
+		slog.String("method", w.req.Method),
+		slog.String("path", w.req.URL.Path),
+		slog.String("op", w.failed.Op),
+		slog.String("kind", w.failed.kind()),
+		slog.String("error", w.failed.Err.Error()),
+	)
+}
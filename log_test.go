@@ -0,0 +1,82 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// A syncBuffer is a bytes.Buffer which is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestLogger requests files from an http.FileServer wrapped with a
+// Config having a Logger, and checks the decisions logged.
+func TestLogger(t *testing.T) {
+	fs := http.FileServer(http.Dir("testdata"))
+	for _, tc := range []struct {
+		path       string
+		reqHeaders []string
+		level      slog.Level
+		expected   []string
+	}{
+		{"/4096bytes.txt", []string{"Accept-Encoding: gzip"},
+			slog.LevelDebug, []string{
+				`accept_encoding=gzip`,
+				`encodings=gzip`,
+				`content_type="text/plain; charset=utf-8"`,
+				`buffered=4096`,
+				`verdict=gzip`}},
+		{"/4096bytes.bin", []string{"Accept-Encoding: gzip, identity"},
+			slog.LevelDebug, []string{
+				`encodings=gzip,identity`,
+				`content_type=application/octet-stream`,
+				`verdict="skip: content-type"`}},
+		{"/4096bytes.txt", []string{"Accept-Encoding: *;q=0"},
+			slog.LevelDebug, []string{
+				`verdict="skip: not-acceptable"`}},
+		{"/4096bytes.txt", []string{"Accept-Encoding: gzip"},
+			slog.LevelInfo, nil},
+	} {
+		var buf syncBuffer
+		logger := slog.New(slog.NewTextHandler(
+			&buf, &slog.HandlerOptions{Level: tc.level}))
+		c := &httpgzip.Config{Logger: logger}
+		_, _ = getPathConfig(t, fs, defComp, c, tc.path, tc.reqHeaders)
+		log := buf.String()
+		if tc.expected == nil && log != "" {
+			t.Fatalf("\nexpected nothing logged, got %s", log)
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(log, " "+e) {
+				t.Fatalf(
+					"\nfile %s, request headers %v\n"+
+						"expected %s logged, got %s",
+					tc.path, tc.reqHeaders, e, log)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A histogram counts observed values in buckets with the given upper
+// bounds, and a final bucket for values above all the bounds.
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Metrics is an Observer which aggregates the Stats of responses into
+// counters and histograms. The zero value is ready to use, and is
+// safe for concurrent use.
+//
+// Metrics implements the expvar.Var interface, so it can be
+// published as JSON using expvar.Publish, and implements
+// http.Handler, serving the metrics in the Prometheus text exposition
+// format.
+//
+// The metrics are: the number of responses by content coding; the
+// number of responses not gzip compressed by SkipReason (which
+// includes 406 Not Acceptable responses); the total uncompressed and
+// compressed bytes of all responses; the number of compressors newly
+// allocated because none was available to reuse; the total time spent
+// compressing; and, for gzip compressed responses, histograms of the
+// uncompressed size and of the compression ratio (compressed size
+// divided by uncompressed size); and the number of responses whose
+// writing failed, by whether the error was returned by the
+// compressor, by the decoder used by Transcode or in writing to the
+// client.
+type Metrics struct {
+	mu         sync.Mutex
+	responses  map[string]int64
+	skipped    map[SkipReason]int64
+	bytesIn    int64
+	bytesOut   int64
+	poolMisses int64
+	errors     map[string]int64
+	seconds    float64
+	sizes      *histogram
+	ratios     *histogram
+}
+
+// Observe implements the Observer interface.
+func (m *Metrics) Observe(r *http.Request, s Stats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.responses == nil {
+		m.responses = map[string]int64{}
+		m.skipped = map[SkipReason]int64{}
+		m.errors = map[string]int64{}
+		m.sizes = newHistogram(
+			512, 1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20)
+		m.ratios = newHistogram(
+			0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1)
+	}
+	if s.Skip == SkipNotAcceptable {
+		m.skipped[s.Skip]++
+		return
+	}
+	m.responses[s.Coding]++
+	if s.Skip != NotSkipped {
+		m.skipped[s.Skip]++
+	}
+	m.bytesIn += s.UncompressedBytes
+	m.bytesOut += s.CompressedBytes
+	if s.PoolMiss {
+		m.poolMisses++
+	}
+	if e, ok := s.Err.(*Error); ok {
+		m.errors[e.kind()]++
+	}
+	m.seconds += s.CompressTime.Seconds()
+	if s.Skip == NotSkipped {
+		m.sizes.observe(float64(s.UncompressedBytes))
+		if s.UncompressedBytes > 0 {
+			m.ratios.observe(
+				float64(s.CompressedBytes) / float64(s.UncompressedBytes))
+		}
+	}
+}
+
+// String implements the expvar.Var interface, returning the metrics
+// as a JSON object.
+func (m *Metrics) String() string {
+	type jsonHistogram struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Sum     float64          `json:"sum"`
+		Count   int64            `json:"count"`
+	}
+	histo := func(h *histogram) jsonHistogram {
+		j := jsonHistogram{Buckets: map[string]int64{}}
+		if h == nil {
+			return j
+		}
+		for i, b := range h.bounds {
+			j.Buckets[strconv.FormatFloat(b, 'g', -1, 64)] = h.counts[i]
+		}
+		j.Buckets["+Inf"] = h.counts[len(h.bounds)]
+		j.Sum, j.Count = h.sum, h.count
+		return j
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	skipped := map[string]int64{}
+	for r, n := range m.skipped {
+		skipped[r.String()] = n
+	}
+	b, _ := json.Marshal(struct {
+		Responses      map[string]int64 `json:"responses"`
+		Skipped        map[string]int64 `json:"skipped"`
+		BytesIn        int64            `json:"bytes_in"`
+		BytesOut       int64            `json:"bytes_out"`
+		PoolMisses     int64            `json:"pool_misses"`
+		Errors         map[string]int64 `json:"errors"`
+		CompressTime   float64          `json:"compress_seconds"`
+		ResponseSizes  jsonHistogram    `json:"response_bytes"`
+		CompressRatios jsonHistogram    `json:"compression_ratio"`
+	}{
+		Responses:      m.responses,
+		Skipped:        skipped,
+		BytesIn:        m.bytesIn,
+		BytesOut:       m.bytesOut,
+		PoolMisses:     m.poolMisses,
+		Errors:         m.errors,
+		CompressTime:   m.seconds,
+		ResponseSizes:  histo(m.sizes),
+		CompressRatios: histo(m.ratios),
+	})
+	return string(b)
+}
+
+// labelValueReplacer escapes label values in the Prometheus text
+// exposition format.
+var labelValueReplacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP implements the http.Handler interface, serving the
+// metrics in the Prometheus text exposition format.
+//
+// ref: https://prometheus.io/docs/instrumenting/exposition_formats/
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	header := func(name, typ, help string) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	value := func(name string, v float64) {
+		fmt.Fprintf(&buf, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	labelled := func(name, label string, values map[string]int64) {
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s{%s=\"%s\"} %d\n",
+				name, label, labelValueReplacer.Replace(k), values[k])
+		}
+	}
+	histo := func(name string, h *histogram) {
+		if h == nil {
+			h = newHistogram()
+		}
+		var cum int64
+		for i, b := range h.bounds {
+			cum += h.counts[i]
+			fmt.Fprintf(&buf, "%s_bucket{le=\"%s\"} %d\n",
+				name, strconv.FormatFloat(b, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(&buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		value(name+"_sum", h.sum)
+		value(name+"_count", float64(h.count))
+	}
+	m.mu.Lock()
+	skipped := map[string]int64{}
+	for r, n := range m.skipped {
+		skipped[r.String()] = n
+	}
+	header("httpgzip_responses_total", "counter",
+		"Responses by content coding.")
+	labelled("httpgzip_responses_total", "coding", m.responses)
+	header("httpgzip_skipped_total", "counter",
+		"Responses not gzip compressed by reason.")
+	labelled("httpgzip_skipped_total", "reason", skipped)
+	header("httpgzip_uncompressed_bytes_total", "counter",
+		"Bytes written by wrapped handlers.")
+	value("httpgzip_uncompressed_bytes_total", float64(m.bytesIn))
+	header("httpgzip_compressed_bytes_total", "counter",
+		"Bytes written to clients.")
+	value("httpgzip_compressed_bytes_total", float64(m.bytesOut))
+	header("httpgzip_pool_misses_total", "counter",
+		"Compressors allocated because none was available for reuse.")
+	value("httpgzip_pool_misses_total", float64(m.poolMisses))
+	header("httpgzip_errors_total", "counter",
+		"Responses whose writing failed by kind of error.")
+	labelled("httpgzip_errors_total", "kind", m.errors)
+	header("httpgzip_compress_seconds_total", "counter",
+		"Time spent compressing.")
+	value("httpgzip_compress_seconds_total", m.seconds)
+	header("httpgzip_response_bytes", "histogram",
+		"Uncompressed size of gzip compressed responses.")
+	histo("httpgzip_response_bytes", m.sizes)
+	header("httpgzip_compression_ratio", "histogram",
+		"Compressed size divided by uncompressed size of gzip compressed responses.")
+	histo("httpgzip_compression_ratio", m.ratios)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = buf.WriteTo(w)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestMetrics requests files from an http.FileServer wrapped with a
+// Config whose Observer is a Metrics, and checks the metrics exposed
+// by its String and ServeHTTP methods.
+func TestMetrics(t *testing.T) {
+	m := &httpgzip.Metrics{}
+	c := &httpgzip.Config{Observer: m}
+	fs := http.FileServer(http.Dir("testdata"))
+	for _, req := range []struct {
+		path    string
+		headers []string
+	}{
+		{"/4096bytes.txt", []string{"Accept-Encoding: gzip"}},
+		{"/4096bytes.txt", []string{"Accept-Encoding: gzip"}},
+		{"/511bytes.txt", []string{"Accept-Encoding: gzip"}},
+		{"/4096bytes.txt", []string{"Accept-Encoding: identity;q=0"}},
+	} {
+		_, _ = getPathConfig(t, fs, defComp, c, req.path, req.headers)
+	}
+	var vars struct {
+		Responses map[string]int64 `json:"responses"`
+		Skipped   map[string]int64 `json:"skipped"`
+		BytesIn   int64            `json:"bytes_in"`
+	}
+	if err := json.Unmarshal([]byte(m.String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Responses["gzip"] != 2 || vars.Responses["identity"] != 1 ||
+		vars.Skipped["too-small"] != 1 ||
+		vars.Skipped["not-acceptable"] != 1 ||
+		vars.BytesIn != 2*4096+511 {
+		t.Fatalf("\nunexpected expvar metrics %s\n", m.String())
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`httpgzip_responses_total{coding="gzip"} 2`,
+		`httpgzip_skipped_total{reason="not-acceptable"} 1`,
+		`httpgzip_uncompressed_bytes_total 8703`,
+		`httpgzip_compression_ratio_bucket{le="+Inf"} 2`,
+		`httpgzip_response_bytes_bucket{le="4096"} 2`,
+		`httpgzip_response_bytes_count 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Fatalf(
+				"\nexpected line %s in Prometheus metrics, got\n%s",
+				line, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A SkipReason is the reason a response was not gzip compressed.
+type SkipReason int
+
+const (
+	// NotSkipped means the response was gzip compressed.
+	NotSkipped SkipReason = iota
+	// SkipTooSmall means the response was smaller than 512 bytes.
+	SkipTooSmall
+	// SkipContentType means the response's content type was not in
+	// the handler's list of content types.
+	SkipContentType
+	// SkipPresetEncoding means the wrapped handler set a
+	// Content-Encoding header itself.
+	SkipPresetEncoding
+	// SkipClientRefused means the request did not prefer gzip
+	// encoding.
+	SkipClientRefused
+	// SkipNotAcceptable means the request accepted neither gzip nor
+	// identity encoding or, with the Config's Transcode field, the
+	// content coding of the response, which could not be decoded, so
+	// 406 Not Acceptable status was sent.
+	SkipNotAcceptable
+	// SkipAdaptive means the handler's AdaptiveLevel skipped
+	// compression because of CPU pressure.
+	SkipAdaptive
+	// SkipConcurrency means the handler was already compressing
+	// MaxCompressors responses. If the request did not accept
+	// identity encoding, 503 Service Unavailable status was sent.
+	SkipConcurrency
+	// SkipIncompressible means the start of the response had too
+	// high an entropy for compression to save the Config's
+	// MinSaving.
+	SkipIncompressible
+	// SkipBreach means the Config's BreachMitigation skipped
+	// compression because the response set a cookie or the request
+	// was cross-site.
+	SkipBreach
+	// SkipNoBody means the response's status, such as 304 Not
+	// Modified, does not allow it to have a body.
+	SkipNoBody
+)
+
+var skipReasonNames = []string{
+	NotSkipped:         "none",
+	SkipTooSmall:       "too-small",
+	SkipContentType:    "content-type",
+	SkipPresetEncoding: "preset-encoding",
+	SkipClientRefused:  "client-refused",
+	SkipNotAcceptable:  "not-acceptable",
+	SkipAdaptive:       "adaptive",
+	SkipConcurrency:    "concurrency-limit",
+	SkipIncompressible: "incompressible",
+	SkipBreach:         "breach",
+	SkipNoBody:         "no-body",
+}
+
+func (r SkipReason) String() string {
+	if r < 0 || int(r) >= len(skipReasonNames) {
+		return "unknown"
+	}
+	return skipReasonNames[r]
+}
+
+// Stats describes a response written by a handler returned from
+// NewHandlerConfig.
+type Stats struct {
+	// Coding is the content coding of the response: "gzip",
+	// "identity", a dictionary content coding such as "dcz", or
+	// the Content-Encoding set by the wrapped handler. It is empty
+	// for 406 Not Acceptable responses.
+	Coding string
+	// Level is the compression level used if the response was gzip
+	// compressed.
+	Level int
+	// UncompressedBytes is the number of bytes written by the
+	// wrapped handler, after any decoding done because of the
+	// Config's Transcode field.
+	UncompressedBytes int64
+	// CompressedBytes is the number of bytes written to the
+	// client. It equals UncompressedBytes if the response was not
+	// compressed.
+	CompressedBytes int64
+	// CompressTime is the time spent in the compressor, not
+	// including the time spent writing its output to the client.
+	CompressTime time.Duration
+	// ContentType is the content type of the response.
+	ContentType string
+	// Skip is the reason the response was not compressed.
+	Skip SkipReason
+	// PoolMiss is true if the compressor used was newly allocated
+	// rather than reused from a pool.
+	PoolMiss bool
+	// TransferCoding is true if the response was compressed using
+	// the gzip transfer coding rather than a content coding.
+	TransferCoding bool
+	// Unpadded is true if the Config's BreachMitigation asked for
+	// the response to be padded, but it was compressed using a
+	// content coding with no header in which to pad it.
+	Unpadded bool
+	// Err is the *Error writing the response, or nil if it was
+	// written successfully.
+	Err error
+}
+
+// An Observer is passed statistics about every response written by a
+// handler returned from NewHandlerConfig whose Config has it as its
+// Observer field. Observe is called from the handler's goroutine once
+// the response has been written and may be called concurrently for
+// different requests. It is not called if the wrapped handler panics,
+// except when the panic is the one aborting a response whose
+// compressor failed (see Config.OnError).
+type Observer interface {
+	Observe(r *http.Request, s Stats)
+}
+
+// The ObserverFunc type is an adapter to allow the use of ordinary
+// functions as Observers. If f is a function with the appropriate
+// signature, ObserverFunc(f) is an Observer that calls f.
+type ObserverFunc func(r *http.Request, s Stats)
+
+// Observe calls f(r, s).
+func (f ObserverFunc) Observe(r *http.Request, s Stats) {
+	f(r, s)
+}
+
+// stats returns the Stats of the response written by w.
+func (w *gzipResponseWriter) stats() Stats {
+	s := Stats{
+		Coding:            "identity",
+		UncompressedBytes: w.n,
+		CompressedBytes:   w.cw.n,
+		CompressTime:      w.ctime,
+		ContentType:       w.ct,
+		Skip:              w.skip,
+		PoolMiss:          w.poolMiss,
+		Unpadded:          w.unpadded,
+	}
+	if w.failed != nil {
+		s.Err = w.failed
+	}
+	switch {
+	case w.skip == NotSkipped:
+		s.Coding = w.coding
+		s.Level = w.level
+		s.TransferCoding = w.te
+	case w.skip == SkipPresetEncoding:
+		s.Coding = w.Header().Get("Content-Encoding")
+	}
+	return s
+}
+
+// timing returns the value of a Server-Timing header giving the time
+// spent compressing the response written by w.
+func (w *gzipResponseWriter) timing() string {
+	ms := float64(w.ctime) / float64(time.Millisecond)
+	return "gzip;dur=" + strconv.FormatFloat(ms, 'f', 3, 64)
+}
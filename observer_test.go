@@ -0,0 +1,71 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestObserver requests files from an http.FileServer wrapped with a
+// Config having an Observer, and checks the Stats passed to the
+// Observer.
+func TestObserver(t *testing.T) {
+	statsc := make(chan httpgzip.Stats, 1)
+	c := &httpgzip.Config{
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				statsc <- s
+			}),
+	}
+	fs := http.FileServer(http.Dir("testdata"))
+	for _, tc := range []struct {
+		path       string
+		reqHeaders []string
+		coding     string
+		skip       httpgzip.SkipReason
+		size       int64
+	}{
+		{"/4096bytes.txt", []string{"Accept-Encoding: gzip"},
+			"gzip", httpgzip.NotSkipped, 4096},
+		{"/511bytes.txt", []string{"Accept-Encoding: gzip"},
+			"identity", httpgzip.SkipTooSmall, 511},
+		{"/4096bytes.bin", []string{"Accept-Encoding: gzip"},
+			"identity", httpgzip.SkipContentType, 4096},
+		{"/4096bytes.txt", nil,
+			"identity", httpgzip.SkipClientRefused, 4096},
+	} {
+		_, body := getPathConfig(
+			t, fs, httpgzip.BestSpeed, c, tc.path, tc.reqHeaders)
+		s := <-statsc
+		if s.Coding != tc.coding || s.Skip != tc.skip ||
+			s.UncompressedBytes != tc.size ||
+			s.CompressedBytes != int64(len(body)) {
+			t.Fatalf(
+				"\nfile %s, request headers %v\n"+
+					"unexpected stats %+v\n",
+				tc.path, tc.reqHeaders, s)
+		}
+		if s.Coding == "gzip" && (s.Level != httpgzip.BestSpeed ||
+			s.CompressedBytes >= s.UncompressedBytes) {
+			t.Fatalf(
+				"\nfile %s, request headers %v\n"+
+					"unexpected stats %+v\n",
+				tc.path, tc.reqHeaders, s)
+		}
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "text/foobar")
+		_, _ = w.Write(make([]byte, 1024))
+	})
+	_, _ = getPathConfig(
+		t, h, defComp, c, "/", []string{"Accept-Encoding: gzip"})
+	s := <-statsc
+	if s.Coding != "text/foobar" || s.Skip != httpgzip.SkipPresetEncoding {
+		t.Fatalf("\nunexpected stats %+v\n", s)
+	}
+}
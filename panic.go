@@ -0,0 +1,34 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+// abandon gets called instead of Close if the wrapped handler, or w
+// itself, panics. It releases what w holds without writing anything
+// more to the client, so no gzip trailer is written and, once the
+// panic reaches net/http, the connection is aborted rather than the
+// client receiving a truncated response which looks complete. The
+// compressor, which may have been interrupted in the middle of a
+// Write, and the buffers are dropped rather than returned to their
+// pools.
+func (w *gzipResponseWriter) abandon() {
+	w.closing = true
+	w.discard = true
+	w.buf, w.out = nil, nil
+	if w.dec != nil {
+		// anything still being decoded is discarded
+		_ = w.dec.Close()
+		w.dec = nil
+	}
+	w.gw = nil
+	if w.adapting {
+		w.adaptive.release(w.ctime)
+		w.adapting = false
+	}
+	w.releaseCompressor()
+	if w.obs != nil && w.failed != nil {
+		// the response was aborted because of the error
+		w.obs.Observe(w.req, w.stats())
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestPanic checks that when the wrapped handler panics after
+// starting a gzip compressed response, the panic is passed on, the
+// response is not ended with a gzip trailer, its compressor is not
+// returned to the pool and it is not observed.
+func TestPanic(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+		if r.URL.Path == "/panic" {
+			panic("handler panicked")
+		}
+	})
+	pool := &httpgzip.EncoderPool{MaxIdle: 1}
+	var observed []string
+	c := &httpgzip.Config{
+		Pool: pool,
+		Observer: httpgzip.ObserverFunc(
+			func(r *http.Request, s httpgzip.Stats) {
+				observed = append(observed, r.URL.Path)
+			}),
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(path string) (res *httptest.ResponseRecorder, p interface{}) {
+		defer func() {
+			p = recover()
+		}()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res = httptest.NewRecorder()
+		gzh.ServeHTTP(res, req)
+		return res, nil
+	}
+	if _, p := serve("/"); p != nil {
+		t.Fatalf("\nunexpected panic %v\n", p)
+	}
+	if idle := pool.Stats().Idle; idle != 1 {
+		t.Fatalf("\nexpected 1 idle compressor, got %d\n", idle)
+	}
+	res, p := serve("/panic")
+	if p != "handler panicked" {
+		t.Fatalf("\nexpected panic to be passed on, got %v\n", p)
+	}
+	if ce := res.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("\nexpected Content-Encoding gzip, got %q\n", ce)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(res.Body.Bytes()))
+	if err == nil {
+		_, err = ioutil.ReadAll(zr)
+	}
+	if err == nil {
+		t.Fatalf("\nexpected truncated gzip stream\n")
+	}
+	if idle := pool.Stats().Idle; idle != 0 {
+		t.Fatalf("\nexpected compressor not to be pooled, "+
+			"got %d idle\n", idle)
+	}
+	if len(observed) != 1 || observed[0] != "/" {
+		t.Fatalf("\nunexpected observed responses %v\n", observed)
+	}
+}
+
+// TestPanicTranscode checks that when a response is being transcoded,
+// a panic in a callback made while writing the decoded response, which
+// happens on the decoding goroutine, is passed on by the handler.
+func TestPanicTranscode(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflated := zlibData(t, data)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "deflate")
+		_, _ = w.Write(deflated)
+	})
+	c := &httpgzip.Config{
+		Transcode: true,
+		GzipHeader: func(r *http.Request, h http.Header) httpgzip.GzipHeader {
+			panic("gzip header panicked")
+		},
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := func() (p interface{}) {
+		defer func() {
+			p = recover()
+		}()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		gzh.ServeHTTP(httptest.NewRecorder(), req)
+		return nil
+	}()
+	if p != "gzip header panicked" {
+		t.Fatalf("\nexpected panic to be passed on, got %v\n", p)
+	}
+}
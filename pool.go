@@ -0,0 +1,215 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// An EncoderPool holds idle compressors for reuse by handlers. A pool
+// for each content coding and compression level is created the first
+// time a compressor for it is needed. It is used by setting the Pool
+// field of a Config; handlers whose Config has no Pool share
+// DefaultEncoderPool.
+//
+// If MaxIdle and MaxIdleBytes are both zero, idle compressors are
+// held in sync.Pools, without taking any lock, and so may be freed by
+// the garbage collector at any time. Otherwise they are held until
+// reused, and when a compressor returned to the pool would exceed
+// either limit, the compressors idle for longest, of any coding and
+// level, are discarded to make room for it. Each compressor is
+// counted at an estimate of the memory it holds, which is about 300KB
+// at NoCompression, 800KB at BestSpeed and 1MB or more at higher
+// levels.
+//
+// EncoderPool implements the expvar.Var interface, so its statistics
+// can be published as JSON using expvar.Publish.
+//
+// An EncoderPool must not be copied after first use.
+type EncoderPool struct {
+	// MaxIdle, if positive, limits the number of idle compressors
+	// retained.
+	MaxIdle int
+	// MaxIdleBytes, if positive, limits the estimated memory held
+	// by idle compressors retained.
+	MaxIdleBytes int64
+
+	pools sync.Map // poolKey to *sync.Pool, if unbounded
+
+	// counters of PoolStats
+	hits, allocs, allocBytes, discards atomic.Int64
+
+	mu        sync.Mutex    // guards the fields below
+	idle      []idleEncoder // retained if bounded, oldest first
+	idleBytes int64
+}
+
+// DefaultEncoderPool is the EncoderPool used by handlers whose Config
+// has no Pool.
+var DefaultEncoderPool = &EncoderPool{}
+
+// PoolStats are the statistics of an EncoderPool.
+type PoolStats struct {
+	// Hits is the number of compressors reused from the pool.
+	Hits int64 `json:"hits"`
+	// Allocs is the number of compressors allocated because none
+	// was available for reuse, and AllocBytes their estimated
+	// memory.
+	Allocs     int64 `json:"allocs"`
+	AllocBytes int64 `json:"alloc_bytes"`
+	// Discards is the number of compressors not retained, or
+	// discarded after being retained, because the pool's limits were
+	// reached.
+	Discards int64 `json:"discards"`
+	// Idle is the number of idle compressors retained, and IdleBytes
+	// their estimated memory. They are only counted if the pool has
+	// a limit.
+	Idle      int   `json:"idle"`
+	IdleBytes int64 `json:"idle_bytes"`
+}
+
+// A poolKey identifies the compressors which can be reused for one
+// another.
+type poolKey struct {
+	coding string
+	level  int
+}
+
+// An idleEncoder is an idle compressor retained by a bounded
+// EncoderPool.
+type idleEncoder struct {
+	key  poolKey
+	enc  interface{}
+	size int64
+}
+
+// encoderSize returns the estimated memory held by an idle compressor
+// for coding at level. Every pooled coding compresses using a
+// compress/flate Writer, whose size depends on level. A gzip Writer,
+// pooled as "gzip", or zlib Writer using a preset dictionary, pooled
+// under a key starting "zlib/", holds little else. A pgzip Writer,
+// pooled as "gzip-parallel", also keeps the last 32KB it compressed
+// as a dictionary; the blocks it compresses in parallel, BlockSize
+// bytes for each of Workers, are only held while it is in use.
+func encoderSize(coding string, level int) int64 {
+	var size int64
+	switch {
+	case level == NoCompression:
+		size = 320 << 10
+	case level == BestSpeed:
+		size = 800 << 10
+	case level == 2 || level == 3:
+		size = 1200 << 10
+	default:
+		size = 1 << 20
+	}
+	if coding == "gzip-parallel" {
+		size += 32 << 10
+	}
+	return size
+}
+
+// bounded reports whether p has a limit.
+func (p *EncoderPool) bounded() bool {
+	return p.MaxIdle > 0 || p.MaxIdleBytes > 0
+}
+
+// syncPool returns the sync.Pool for key, creating it if necessary.
+func (p *EncoderPool) syncPool(key poolKey) *sync.Pool {
+	if sp, ok := p.pools.Load(key); ok {
+		return sp.(*sync.Pool)
+	}
+	sp, _ := p.pools.LoadOrStore(key, &sync.Pool{})
+	return sp.(*sync.Pool)
+}
+
+// takeIdle removes the most recently retained idle compressor for key
+// from p.idle and returns it, or nil if there is none. It must be
+// called with p.mu held.
+func (p *EncoderPool) takeIdle(key poolKey) interface{} {
+	for i := len(p.idle) - 1; i >= 0; i-- {
+		if e := p.idle[i]; e.key == key {
+			copy(p.idle[i:], p.idle[i+1:])
+			p.idle[len(p.idle)-1] = idleEncoder{}
+			p.idle = p.idle[:len(p.idle)-1]
+			p.idleBytes -= e.size
+			return e.enc
+		}
+	}
+	return nil
+}
+
+// get returns an idle compressor for coding at level, or one returned
+// by alloc if there is none, in which case miss is true. Unless p is
+// bounded it takes no lock.
+func (p *EncoderPool) get(coding string, level int, alloc func() interface{}) (enc interface{}, miss bool) {
+	key := poolKey{coding, level}
+	if p.bounded() {
+		p.mu.Lock()
+		enc = p.takeIdle(key)
+		p.mu.Unlock()
+	} else {
+		enc = p.syncPool(key).Get()
+	}
+	if enc != nil {
+		p.hits.Add(1)
+		return enc, false
+	}
+	p.allocs.Add(1)
+	p.allocBytes.Add(encoderSize(coding, level))
+	return alloc(), true
+}
+
+// put returns a compressor for coding at level to the pool, first
+// discarding the compressors idle for longest if retaining it would
+// exceed the pool's limits.
+func (p *EncoderPool) put(coding string, level int, enc interface{}) {
+	key := poolKey{coding, level}
+	if !p.bounded() {
+		p.syncPool(key).Put(enc)
+		return
+	}
+	size := encoderSize(coding, level)
+	if p.MaxIdleBytes > 0 && size > p.MaxIdleBytes {
+		p.discards.Add(1)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for n < len(p.idle) &&
+		(p.MaxIdle > 0 && len(p.idle)-n+1 > p.MaxIdle ||
+			p.MaxIdleBytes > 0 && p.idleBytes+size > p.MaxIdleBytes) {
+		p.idleBytes -= p.idle[n].size
+		p.discards.Add(1)
+		p.idle[n] = idleEncoder{}
+		n++
+	}
+	p.idle = append(p.idle[n:], idleEncoder{key, enc, size})
+	p.idleBytes += size
+}
+
+// Stats returns the statistics of p.
+func (p *EncoderPool) Stats() PoolStats {
+	s := PoolStats{
+		Hits:       p.hits.Load(),
+		Allocs:     p.allocs.Load(),
+		AllocBytes: p.allocBytes.Load(),
+		Discards:   p.discards.Load(),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.Idle, s.IdleBytes = len(p.idle), p.idleBytes
+	return s
+}
+
+// String implements the expvar.Var interface, returning the
+// statistics of p as a JSON object.
+func (p *EncoderPool) String() string {
+	b, _ := json.Marshal(p.Stats())
+	return string(b)
+}
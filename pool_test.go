@@ -0,0 +1,79 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestEncoderPool makes sequential requests to two handlers sharing
+// an EncoderPool with MaxIdle 1, and checks the pool's statistics
+// after each request, including that the compressor idle for longest
+// is discarded to make room for one of another level.
+func TestEncoderPool(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	})
+	pool := &httpgzip.EncoderPool{MaxIdle: 1}
+	handlers := map[int]http.Handler{}
+	for _, level := range []int{defComp, httpgzip.BestSpeed} {
+		handlers[level], err = httpgzip.NewHandlerConfig(
+			h, nil, level, &httpgzip.Config{Pool: pool})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tc := range []struct {
+		level int
+		stats httpgzip.PoolStats
+	}{
+		{defComp, httpgzip.PoolStats{
+			Allocs: 1, AllocBytes: 1 << 20,
+			Idle: 1, IdleBytes: 1 << 20}},
+		{defComp, httpgzip.PoolStats{
+			Hits: 1, Allocs: 1, AllocBytes: 1 << 20,
+			Idle: 1, IdleBytes: 1 << 20}},
+		{httpgzip.BestSpeed, httpgzip.PoolStats{
+			Hits: 1, Allocs: 2, AllocBytes: 1<<20 + 800<<10,
+			Discards: 1, Idle: 1, IdleBytes: 800 << 10}},
+		{httpgzip.BestSpeed, httpgzip.PoolStats{
+			Hits: 2, Allocs: 2, AllocBytes: 1<<20 + 800<<10,
+			Discards: 1, Idle: 1, IdleBytes: 800 << 10}},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp := httptest.NewRecorder()
+		handlers[tc.level].ServeHTTP(resp, req)
+		if ce := resp.Header().Get("Content-Encoding"); ce != "gzip" {
+			t.Fatalf(
+				"\nrequest %d\nexpected Content-Encoding gzip, got %q\n",
+				i, ce)
+		}
+		if s := pool.Stats(); s != tc.stats {
+			t.Fatalf(
+				"\nrequest %d\nexpected stats %+v\ngot %+v\n",
+				i, tc.stats, s)
+		}
+	}
+	var s httpgzip.PoolStats
+	if err := json.Unmarshal([]byte(pool.String()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s != pool.Stats() {
+		t.Fatalf("\nexpected JSON stats %+v\ngot %+v\n", pool.Stats(), s)
+	}
+}
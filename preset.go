@@ -0,0 +1,126 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// A PresetDictionary configures compression using a preset DEFLATE
+// dictionary, which greatly improves the compression of small
+// responses, such as JSON API responses, which share much of their
+// content with the dictionary. Responses are sent in the zlib format,
+// which identifies the dictionary by its Adler-32 checksum, so the
+// client must already have it.
+//
+// A PresetDictionary is used on the server by setting the Preset field
+// of a Config, and on the client by adding it to the Presets field of
+// a Transport.
+type PresetDictionary struct {
+	// Coding is the content coding of responses compressed using
+	// the dictionary. It may be "deflate", or a custom coding such
+	// as "x-deflate-dict".
+	Coding string
+	// Dict is the dictionary. It must not be modified after first
+	// use.
+	Dict []byte
+	// Accept, if not nil, reports whether the client making the
+	// request r has the dictionary. Responses are only compressed
+	// using the dictionary if they would otherwise be gzip
+	// compressed, the request accepts Coding and Accept returns
+	// true. No browser supports preset dictionaries, so
+	// Accept is required if Coding is "deflate" and should recognise
+	// only your own clients.
+	Accept func(r *http.Request) bool
+
+	poolKey string
+}
+
+// validate returns an error if p has invalid settings. Otherwise it
+// lower-cases p.Coding and sets p.poolKey, so it should be called on
+// a copy of the caller's PresetDictionary.
+func (p *PresetDictionary) validate() error {
+	p.Coding = strings.ToLower(p.Coding)
+	switch {
+	case p.Coding == "" || p.Coding == "gzip" || p.Coding == "x-gzip" ||
+		p.Coding == "identity" || p.Coding == "*":
+		return fmt.Errorf(
+			"httpgzip: invalid preset dictionary coding: %q", p.Coding)
+	case len(p.Dict) == 0:
+		return fmt.Errorf("httpgzip: empty preset dictionary")
+	case p.Coding == "deflate" && p.Accept == nil:
+		return fmt.Errorf(
+			"httpgzip: preset dictionary for deflate coding needs Accept")
+	}
+	// compressors for different dictionaries must not share a pool
+	sum := sha256.Sum256(p.Dict)
+	p.poolKey = "zlib/" + hex.EncodeToString(sum[:8])
+	return nil
+}
+
+// accepted reports whether the response to r may be compressed using
+// p.
+func (p *PresetDictionary) accepted(r *http.Request) bool {
+	qs := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+	if q, ok := qs[p.Coding]; !ok || q == 0 {
+		return false
+	}
+	return p.Accept == nil || p.Accept(r)
+}
+
+// getPresetCompressor takes a zlib.Writer using w.preset's dictionary
+// from w.pool and resets it to write to w.cw.
+func (w *gzipResponseWriter) getPresetCompressor() {
+	level, dict := w.level, w.preset.Dict
+	w.gwPool = w.preset.poolKey
+	zw, miss := w.pool.get(w.gwPool, level, func() interface{} {
+		zw, _ := zlib.NewWriterLevelDict(nil, level, dict)
+		return zw
+	})
+	w.gw, w.poolMiss = zw.(*zlib.Writer), miss
+	w.gw.Reset(&w.cw)
+}
+
+// presetDicts returns the dictionaries in presets for the content
+// coding c.
+func presetDicts(presets []*PresetDictionary, c string) [][]byte {
+	var dicts [][]byte
+	for _, p := range presets {
+		if strings.EqualFold(p.Coding, c) {
+			dicts = append(dicts, p.Dict)
+		}
+	}
+	return dicts
+}
+
+// presetDecoder returns a decoder for the zlib format which uses
+// whichever of dicts the data names, if any.
+func presetDecoder(dicts [][]byte) func(r io.Reader) (io.ReadCloser, error) {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		br := bufio.NewReader(r)
+		var dict []byte
+		// the FDICT flag is bit 5 of the second byte, and is
+		// followed by the dictionary's Adler-32 checksum
+		if hdr, err := br.Peek(6); err == nil && hdr[1]&0x20 != 0 {
+			id := binary.BigEndian.Uint32(hdr[2:])
+			for _, d := range dicts {
+				if adler32.Checksum(d) == id {
+					dict = d
+					break
+				}
+			}
+		}
+		return zlib.NewReaderDict(br, dict)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// presetJSON returns a JSON document sharing most of its content with
+// the others it returns.
+func presetJSON(id int) string {
+	var items []string
+	for i := 0; i < 8; i++ {
+		items = append(items, fmt.Sprintf(
+			`{"id":%d,"name":"item %d","description":"an example item",`+
+				`"tags":["example","preset","dictionary"],"price":%d}`,
+			id*10+i, i, id+i))
+	}
+	return `{"items":[` + strings.Join(items, ",") + `]}`
+}
+
+// TestPresetDictionary requests JSON documents from handlers
+// compressing them with a preset dictionary using the "deflate" and a
+// custom content coding, using a Transport which has the dictionary.
+func TestPresetDictionary(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(presetJSON(7)))
+	})
+	dict := []byte(presetJSON(1))
+	oldDict := []byte(presetJSON(2))
+	ours := func(r *http.Request) bool {
+		return r.Header.Get("X-Client") == "ours"
+	}
+	for _, tc := range []struct {
+		preset  httpgzip.PresetDictionary
+		headers []string
+		coding  string
+	}{
+		{httpgzip.PresetDictionary{Coding: "X-Deflate-Dict", Dict: dict},
+			nil, "x-deflate-dict"},
+		{httpgzip.PresetDictionary{
+			Coding: "deflate", Dict: dict, Accept: ours},
+			[]string{"X-Client: ours"}, "deflate"},
+		{httpgzip.PresetDictionary{
+			Coding: "deflate", Dict: dict, Accept: ours},
+			nil, "gzip"},
+	} {
+		preset := tc.preset
+		gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp,
+			&httpgzip.Config{Preset: &preset})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(gzh)
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		for _, h := range tc.headers {
+			req.Header.Add(parseHeader(h))
+		}
+		client := http.Client{Transport: &httpgzip.Transport{
+			Presets: []*httpgzip.PresetDictionary{
+				{Coding: tc.preset.Coding, Dict: oldDict},
+				{Coding: tc.preset.Coding, Dict: dict},
+			},
+		}}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != presetJSON(7) {
+			t.Fatalf("\ncoding %s, body differs\n", tc.coding)
+		}
+		db, ok := res.Body.(*httpgzip.DecodedBody)
+		if !ok || db.Coding() != tc.coding {
+			t.Fatalf("\nexpected coding %s, got %T %v\n",
+				tc.coding, res.Body, db)
+		}
+		if tc.coding != "gzip" && db.CompressedBytes() > 200 {
+			t.Fatalf("\ncoding %s, expected small response, got %d bytes\n",
+				tc.coding, db.CompressedBytes())
+		}
+	}
+	for _, p := range []httpgzip.PresetDictionary{
+		{Coding: "gzip", Dict: dict},
+		{Coding: "x-deflate-dict"},
+		{Coding: "deflate", Dict: dict},
+	} {
+		c := &httpgzip.Config{Preset: &p}
+		if _, err := httpgzip.NewHandlerConfig(h, nil, defComp, c); err == nil {
+			t.Fatalf("\npreset %+v, expected error\n", p)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// checkEncoding gets called by Write the first time it is called. If
+// w.transcode is true and the wrapped handler has set a
+// Content-Encoding header using codings which are not all acceptable
+// to the client, and which can all be decoded, it removes the
+// Content-Encoding, Content-Length and Accept-Ranges headers and
+// starts a decodingWriter which decodes the response and passes the
+// result to the write method. If the codings cannot all be decoded it
+// arranges for a 406 Not Acceptable status to be sent instead, unless
+// the request has no Accept-Encoding header, and so accepts any
+// coding. Partial content responses are left alone since a byte range
+// of an encoded response cannot be decoded.
+func (w *gzipResponseWriter) checkEncoding() {
+	w.checked = true
+	if !w.transcode || w.httpStatus == http.StatusPartialContent {
+		return
+	}
+	codings := parseCodings(
+		strings.Join(w.Header().Values("Content-Encoding"), ","))
+	if len(codings) == 0 {
+		return
+	}
+	accepted, decodable := true, true
+	for _, c := range codings {
+		if !codingAccepted(w.accept, c) {
+			accepted = false
+		}
+		if _, ok := decoder(c); !ok {
+			decodable = false
+		}
+	}
+	if accepted {
+		return
+	}
+	if !decodable {
+		// ref: https://www.rfc-editor.org/rfc/rfc9110#section-12.5.3
+		if _, ok := w.req.Header["Accept-Encoding"]; ok {
+			w.notAcceptable()
+		}
+		return
+	}
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	w.Header().Del("Accept-Ranges")
+	w.dec = newDecodingWriter(codings, writerFunc(w.write))
+}
+
+// notAcceptable gets called by checkEncoding when the wrapped handler
+// has encoded the response using a content coding which the client
+// refuses and which cannot be decoded. It arranges for a 406 Not
+// Acceptable status to be sent instead, discarding the response body.
+func (w *gzipResponseWriter) notAcceptable() {
+	w.httpStatus = http.StatusNotAcceptable
+	w.discard = true
+	w.skip = SkipNotAcceptable
+	for _, h := range []string{"Content-Encoding", "Content-Type",
+		"Content-Range", "Accept-Ranges", "ETag", "Last-Modified"} {
+		w.Header().Del(h)
+	}
+	w.Header().Set("Content-Length", "0")
+}
+
+// A writerFunc is a function which implements io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// A decodingWriter is an io.WriteCloser which decodes the content
+// codings in codings from the data written to it and writes the
+// result to an underlying io.Writer.
+//
+// Since the decoders are io.Readers, decoding happens in a separate
+// goroutine which reads the written data using the Read method. So
+// that the goroutine never runs concurrently with the caller, Write
+// does not return until the goroutine has consumed all of p and is
+// waiting for more, and Close does not return until the goroutine has
+// finished. A panic in the goroutine, where nothing would recover it,
+// is recovered and passed on by Write or Close on the caller's
+// goroutine.
+type decodingWriter struct {
+	in       chan []byte   // data passed from Write to Read
+	ack      chan struct{} // signals Write that Read wants more
+	done     chan struct{} // closed when the goroutine finishes
+	buf      []byte        // data not yet read by Read
+	pending  bool          // whether Write is waiting for ack
+	err      error         // error which ended the goroutine
+	panicked interface{}   // value the goroutine panicked with
+}
+
+func newDecodingWriter(codings []string, w io.Writer) *decodingWriter {
+	dw := &decodingWriter{
+		in:   make(chan []byte),
+		ack:  make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(dw.done)
+		defer func() {
+			dw.panicked = recover()
+		}()
+		d := &decodingReader{body: ioutil.NopCloser(dw), codings: codings}
+		_, err := io.Copy(w, d)
+		_ = d.Close()
+		if err == nil {
+			err = io.ErrClosedPipe
+		}
+		dw.err = err
+	}()
+	return dw
+}
+
+// repanic gets called once the decoding goroutine has finished, and
+// panics with the value it panicked with, if it did, the first time it
+// is called.
+func (dw *decodingWriter) repanic() {
+	if p := dw.panicked; p != nil {
+		dw.panicked = nil
+		panic(p)
+	}
+}
+
+// Read is called by the decoding goroutine.
+func (dw *decodingWriter) Read(p []byte) (int, error) {
+	if len(dw.buf) == 0 {
+		if dw.pending {
+			dw.pending = false
+			dw.ack <- struct{}{}
+		}
+		b, ok := <-dw.in
+		if !ok {
+			return 0, io.EOF
+		}
+		dw.buf, dw.pending = b, true
+	}
+	n := copy(p, dw.buf)
+	dw.buf = dw.buf[n:]
+	return n, nil
+}
+
+func (dw *decodingWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	select {
+	case dw.in <- p:
+	case <-dw.done:
+		dw.repanic()
+		return 0, dw.err
+	}
+	select {
+	case <-dw.ack:
+		return len(p), nil
+	case <-dw.done:
+		dw.repanic()
+		if dw.err == io.ErrClosedPipe && len(dw.buf) == 0 {
+			// the encoded data ended exactly at the end of p
+			return len(p), nil
+		}
+		return 0, dw.err
+	}
+}
+
+// Close signals the end of the encoded data and waits for the
+// decoding goroutine to finish, returning any error it encountered.
+func (dw *decodingWriter) Close() error {
+	close(dw.in)
+	<-dw.done
+	dw.repanic()
+	if dw.err == io.ErrClosedPipe {
+		return nil
+	}
+	return dw.err
+}
+
+// NewProxyHandler is like NewHandlerConfig with a Config whose
+// Transcode field is true. It is intended for wrapping handlers, such
+// as httputil.ReverseProxy, which pass through responses that may
+// already be encoded.
+//
+// Responses which h writes without a Content-Encoding header are
+// treated exactly as by NewHandlerLevel. Responses which h encodes
+// using content codings acceptable to the client are passed through
+// untouched. Otherwise, if every coding can be decoded (see
+// RegisterDecoder), the response is decoded and its Content-Encoding,
+// Content-Length and Accept-Ranges headers removed, and then it is
+// treated as if h had written it without encoding: gzip compressed if
+// appropriate or else sent with identity encoding. For example a
+// response from a proxied server encoded with gzip is sent without
+// encoding to clients which do not accept gzip, and one encoded with
+// a registered "br" decoder is sent gzip compressed to clients which
+// only accept gzip. Responses using a coding which cannot be decoded
+// and which the client does not accept are replaced by a 406 Not
+// Acceptable response with an empty body, unless the request has no
+// Accept-Encoding header. Partial content responses are passed through
+// untouched.
+func NewProxyHandler(h http.Handler, contentTypes []string, level int) (http.Handler, error) {
+	return NewHandlerConfig(h, contentTypes, level, &Config{Transcode: true})
+}
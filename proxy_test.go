@@ -0,0 +1,161 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// TestProxyHandler serves a text file from an upstream server which
+// ignores Accept-Encoding and always uses the same content coding,
+// and requests it through an httputil.ReverseProxy wrapped with
+// NewProxyHandler. It checks that the responses are passed through,
+// decoded or transcoded according to the request's Accept-Encoding.
+func TestProxyHandler(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpgzip.RegisterDecoder("x-base64", func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(
+			base64.NewDecoder(base64.StdEncoding, r)), nil
+	})
+	gzipped := gzipData(t, data)
+	for _, tc := range []struct {
+		upstreamEnc  string
+		upstreamBody []byte
+		reqHeaders   []string
+		resEnc       string
+		resBody      []byte // nil means check body decodes to data
+	}{
+		{"gzip", gzipped, []string{"Accept-Encoding: gzip"}, "gzip", gzipped},
+		{"gzip", gzipped, nil, "", data},
+		{"gzip", gzipped, []string{"Accept-Encoding: gzip;q=0"}, "", data},
+		{"gzip", gzipped, []string{"Accept-Encoding: deflate"}, "", data},
+		{"x-base64", []byte(base64.StdEncoding.EncodeToString(data)),
+			[]string{"Accept-Encoding: gzip"}, "gzip", nil},
+		{"", data, []string{"Accept-Encoding: gzip"}, "gzip", nil},
+		{"", data, nil, "", data},
+		{"x-unknown", data, nil, "x-unknown", data},
+	} {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if tc.upstreamEnc != "" {
+					w.Header().Set("Content-Encoding", tc.upstreamEnc)
+				}
+				_, _ = w.Write(tc.upstreamBody)
+			}))
+		u, err := url.Parse(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy, err := httpgzip.NewProxyHandler(
+			httputil.NewSingleHostReverseProxy(u), nil, defComp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, body := getHandler(t, proxy, tc.reqHeaders)
+		upstream.Close()
+		if res.Header.Get("Content-Encoding") != tc.resEnc {
+			t.Fatalf(
+				"\nupstream %s, request headers %v\n"+
+					"expected Content-Encoding %s, got %s\n",
+				tc.upstreamEnc, tc.reqHeaders,
+				tc.resEnc, res.Header.Get("Content-Encoding"))
+		}
+		if tc.resBody == nil {
+			body = gunzip(t, body)
+			tc.resBody = data
+		}
+		if !bytes.Equal(body, tc.resBody) {
+			t.Fatalf(
+				"\nupstream %s, request headers %v\n"+
+					"unexpected body\n",
+				tc.upstreamEnc, tc.reqHeaders)
+		}
+	}
+	// a coding which the client refuses and which cannot be decoded
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "x-unknown")
+			_, _ = w.Write(data)
+		}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := httpgzip.NewProxyHandler(
+		httputil.NewSingleHostReverseProxy(u), nil, defComp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, body := getHandler(t, proxy, []string{"Accept-Encoding: gzip"})
+	if res.StatusCode != http.StatusNotAcceptable ||
+		res.Header.Get("Content-Encoding") != "" ||
+		res.Header.Get("Content-Type") != "" || len(body) != 0 {
+		t.Fatalf("\nexpected empty 406 response, got %d, %v, %d bytes\n",
+			res.StatusCode, res.Header, len(body))
+	}
+}
+
+// getHandler starts a temporary test server using handler h and
+// issues a request for it with the specified headers added, and
+// automatic sending of Accept-Encoding disabled. getHandler returns
+// the http.Response (with Body closed) and the result of reading the
+// response Body.
+func getHandler(t *testing.T, h http.Handler, headers []string) (*http.Response, []byte) {
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		req.Header.Add(parseHeader(h))
+	}
+	transport := &http.Transport{DisableCompression: true}
+	client := http.Client{Transport: transport}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+// gunzip returns the result of decompressing the gzipped data b.
+func gunzip(t *testing.T, b []byte) []byte {
+	if !isGzip(b) {
+		t.Fatalf("\nexpected gzipped data\n")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xi2/httpgzip/internal/gzip"
+)
+
+// decoders maps the supported content codings to functions returning
+// an io.ReadCloser which decodes that coding from r. It is protected
+// by decodersMu.
+var decoders = map[string]func(r io.Reader) (io.ReadCloser, error){
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) {
+		// the "deflate" content coding is the zlib format
+		// ref: https://tools.ietf.org/html/rfc7230#section-4.2.2
+		return zlib.NewReader(r)
+	},
+}
+
+var decodersMu sync.RWMutex
+
+// RegisterDecoder makes a decoder for the content coding named coding
+// available to the handlers returned by NewRequestHandler and to
+// Transport, in addition to the built in gzip and deflate
+// decoders. The function fn returns an io.ReadCloser which decodes
+// that coding from r. Coding names are case insensitive and
+// registering a coding a second time replaces its decoder.
+func RegisterDecoder(coding string, fn func(r io.Reader) (io.ReadCloser, error)) {
+	decodersMu.Lock()
+	decoders[strings.ToLower(coding)] = fn
+	decodersMu.Unlock()
+}
+
+// decoder returns the decoder for the content coding c and whether
+// one is registered.
+func decoder(c string) (func(r io.Reader) (io.ReadCloser, error), bool) {
+	decodersMu.RLock()
+	fn, ok := decoders[c]
+	decodersMu.RUnlock()
+	return fn, ok
+}
+
+// parseCodings returns the content codings listed in the header value
+// h in the order they were applied. Coding names are lower-cased,
+// "x-gzip" is treated as "gzip" and identity codings are dropped.
+func parseCodings(h string) []string {
+	var codings []string
+	for _, s := range strings.Split(h, ",") {
+		c := strings.ToLower(strings.Trim(s, " "))
+		switch c {
+		case "", "identity":
+			continue
+		case "x-gzip":
+			c = "gzip"
+		}
+		codings = append(codings, c)
+	}
+	return codings
+}
+
+// supportedCodings returns a comma separated list of the codings in
+// decoders, suitable for use in an Accept-Encoding header.
+func supportedCodings() string {
+	var codings []string
+	decodersMu.RLock()
+	for c := range decoders {
+		codings = append(codings, c)
+	}
+	decodersMu.RUnlock()
+	sort.Strings(codings)
+	return strings.Join(codings, ", ")
+}
+
+// minRatioSize is the number of decompressed bytes which must be
+// read from a request body before its expansion ratio is checked. It
+// prevents small, highly compressible bodies from being refused.
+const minRatioSize = 1 << 20
+
+// A BodyLimitError is the error returned by the Read method of a
+// request body decoded by a handler returned from
+// NewRequestHandlerLimit when the body exceeds one of the handler's
+// limits.
+type BodyLimitError struct {
+	// MaxSize and MaxRatio are the limits of the handler.
+	MaxSize  int64
+	MaxRatio float64
+	// Size and Compressed are the number of decompressed and
+	// compressed bytes read when the limit was exceeded.
+	Size       int64
+	Compressed int64
+}
+
+func (e *BodyLimitError) Error() string {
+	if e.MaxSize > 0 && e.Size > e.MaxSize {
+		return fmt.Sprintf(
+			"httpgzip: decompressed request body larger than %d bytes",
+			e.MaxSize)
+	}
+	return fmt.Sprintf(
+		"httpgzip: request body expansion ratio larger than %g",
+		e.MaxRatio)
+}
+
+// A countingReader is an io.Reader which counts the bytes read from
+// the underlying io.Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A decodingReader is an io.ReadCloser which decodes the content
+// codings in codings from the underlying body. The decoders are not
+// created until the first call to Read so that any error in the
+// encoded data is returned from Read.
+//
+// If maxSize or maxRatio are positive, Read returns a
+// *BodyLimitError once the decompressed body is larger than maxSize
+// bytes, or is at least minRatioSize bytes and larger than maxRatio
+// times the compressed bytes read. In that case onLimit is called
+// before Read returns.
+//
+// Codings for which presets has dictionaries are decoded from the
+// zlib format using those dictionaries.
+type decodingReader struct {
+	body     io.ReadCloser
+	codings  []string
+	presets  []*PresetDictionary
+	maxSize  int64
+	maxRatio float64
+	onLimit  func()
+	cr       *countingReader
+	r        io.Reader
+	closers  []io.Closer
+	n        int64
+	err      error
+}
+
+func (d *decodingReader) init() {
+	d.cr = &countingReader{r: d.body}
+	d.r = d.cr
+	for i := len(d.codings) - 1; i >= 0; i-- {
+		fn, _ := decoder(d.codings[i])
+		if dicts := presetDicts(d.presets, d.codings[i]); dicts != nil {
+			fn = presetDecoder(dicts)
+		}
+		rc, err := fn(d.r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			d.err = err
+			return
+		}
+		d.closers = append(d.closers, rc)
+		d.r = rc
+	}
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.init()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.maxSize > 0 && int64(len(p)) > d.maxSize-d.n+1 {
+		// read no more than is needed to exceed maxSize
+		p = p[:d.maxSize-d.n+1]
+	}
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	if d.maxSize > 0 && d.n > d.maxSize ||
+		d.maxRatio > 0 && d.n >= minRatioSize &&
+			float64(d.n) > d.maxRatio*float64(d.cr.n) {
+		d.err = &BodyLimitError{
+			MaxSize:    d.maxSize,
+			MaxRatio:   d.maxRatio,
+			Size:       d.n,
+			Compressed: d.cr.n,
+		}
+		if d.onLimit != nil {
+			d.onLimit()
+		}
+		return 0, d.err
+	}
+	return n, err
+}
+
+func (d *decodingReader) Close() error {
+	for _, c := range d.closers {
+		_ = c.Close()
+	}
+	return d.body.Close()
+}
+
+// A limitResponseWriter is a modified http.ResponseWriter used by
+// handlers returned from NewRequestHandlerLimit. Its tooLarge method
+// is called when the request body exceeds a limit, and writes a 413
+// Request Entity Too Large status if the wrapped handler has not yet
+// written a status itself. After that any status or body written by
+// the wrapped handler is discarded.
+type limitResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	err         error
+}
+
+func (w *limitResponseWriter) tooLarge(err error) {
+	if w.wroteHeader {
+		return
+	}
+	w.err = err
+	w.Header().Set("Connection", "close")
+	w.ResponseWriter.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.wroteHeader = true
+}
+
+func (w *limitResponseWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *limitResponseWriter) WriteHeader(httpStatus int) {
+	if w.err != nil {
+		return
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(httpStatus)
+}
+
+// NewRequestHandler returns a new http.Handler which wraps a handler
+// h decompressing the bodies of requests which have a
+// Content-Encoding header. The supported content codings are gzip
+// (also known as x-gzip), deflate and any registered with
+// RegisterDecoder, and several codings may be listed in the header
+// in the order they were applied.
+//
+// Before a request is passed through to h its Body is replaced by
+// one which decodes the content codings, its Content-Encoding and
+// Content-Length headers are removed and its ContentLength is set to
+// -1. Errors in the encoded data are returned by the Body's Read
+// method. Requests listing a content coding which is not supported
+// are answered with 415 Unsupported Media Type status and an
+// Accept-Encoding header listing the supported codings.
+func NewRequestHandler(h http.Handler) http.Handler {
+	rh, _ := NewRequestHandlerLimit(h, 0, 0)
+	return rh
+}
+
+// NewRequestHandlerLimit is like NewRequestHandler but protects h
+// against decompression bombs by limiting the size of decompressed
+// request bodies.
+//
+// If maxSize is positive, decompressed bodies may be no larger than
+// maxSize bytes. If maxRatio is positive, decompressed bodies of at
+// least 1MiB may be no larger than maxRatio times the size of the
+// compressed data read. The limits are enforced while the body is
+// read. Once a limit is exceeded the body's Read method returns a
+// *BodyLimitError and, unless h has already written a status, the
+// response is given 413 Request Entity Too Large status, after which
+// anything h writes is discarded. Zero values mean no limit. The
+// error returned will be nil if the limits are not negative.
+func NewRequestHandlerLimit(h http.Handler, maxSize int64, maxRatio float64) (http.Handler, error) {
+	if maxSize < 0 || maxRatio < 0 {
+		return nil, fmt.Errorf(
+			"httpgzip: invalid request body limits: %d, %g",
+			maxSize, maxRatio)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		codings := parseCodings(
+			strings.Join(r.Header.Values("Content-Encoding"), ","))
+		for _, c := range codings {
+			if _, ok := decoder(c); !ok {
+				w.Header().Set("Accept-Encoding", supportedCodings())
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		if len(codings) > 0 && r.Body != nil && r.Body != http.NoBody {
+			d := &decodingReader{
+				body:     r.Body,
+				codings:  codings,
+				maxSize:  maxSize,
+				maxRatio: maxRatio,
+			}
+			if maxSize > 0 || maxRatio > 0 {
+				lw := &limitResponseWriter{ResponseWriter: w}
+				d.onLimit = func() { lw.tooLarge(d.err) }
+				w = lw
+			}
+			r.Body = d
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+		// call original handler's ServeHTTP
+		h.ServeHTTP(w, r)
+	}), nil
+}
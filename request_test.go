@@ -0,0 +1,217 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// gzipData returns the result of gzip compressing data.
+func gzipData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zlibData returns the result of zlib compressing data.
+func zlibData(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// postBody starts a temporary test server using handler h and issues
+// a POST request with the given body and Content-Encoding header
+// (omitted if empty). postBody returns the http.Response (with Body
+// closed) and the result of reading the response Body.
+func postBody(t *testing.T, h http.Handler, body []byte, enc string) (*http.Response, []byte) {
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, err := http.NewRequest("POST", ts.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, resBody
+}
+
+// echoHandler is a handler which checks the request's encoding
+// headers have been removed and echoes the request body.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Encoding") != "" ||
+		r.Header.Get("Content-Length") != "" || r.ContentLength != -1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(w, r.Body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+})
+
+// TestRequestHandler posts the same file with various content
+// codings to a handler wrapped with NewRequestHandler and checks that
+// it receives the decoded body.
+func TestRequestHandler(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := httpgzip.NewRequestHandler(echoHandler)
+	for _, tc := range []struct {
+		enc  string
+		body []byte
+	}{
+		{"gzip", gzipData(t, data)},
+		{"x-gzip", gzipData(t, data)},
+		{"deflate", zlibData(t, data)},
+		{"deflate, gzip", gzipData(t, zlibData(t, data))},
+		{"identity, GZIP", gzipData(t, data)},
+	} {
+		res, body := postBody(t, h, tc.body, tc.enc)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf(
+				"\nContent-Encoding %s, expected status code %d, got %d\n",
+				tc.enc, http.StatusOK, res.StatusCode)
+		}
+		if !bytes.Equal(body, data) {
+			t.Fatalf(
+				"\nContent-Encoding %s, body not decoded\n", tc.enc)
+		}
+	}
+}
+
+// TestRequestHandlerUnencoded checks that requests without a
+// Content-Encoding header are passed through untouched.
+func TestRequestHandlerUnencoded(t *testing.T) {
+	data := []byte("hello, world")
+	h := httpgzip.NewRequestHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength != int64(len(data)) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = io.Copy(w, r.Body)
+		}))
+	res, body := postBody(t, h, data, "")
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf(
+			"\nexpected status code %d and body %q, got %d and %q\n",
+			http.StatusOK, data, res.StatusCode, body)
+	}
+}
+
+// TestRequestHandlerErrors checks that unsupported codings are
+// refused with 415 Unsupported Media Type and that corrupt encoded
+// data results in an error from the request Body's Read method.
+func TestRequestHandlerErrors(t *testing.T) {
+	h := httpgzip.NewRequestHandler(echoHandler)
+	res, _ := postBody(t, h, []byte("data"), "br")
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf(
+			"\nexpected status code %d, got %d\n",
+			http.StatusUnsupportedMediaType, res.StatusCode)
+	}
+	for _, c := range []string{"gzip", "deflate"} {
+		if !strings.Contains(res.Header.Get("Accept-Encoding"), c) {
+			t.Fatalf(
+				"\nexpected %s in Accept-Encoding, got %s\n",
+				c, res.Header.Get("Accept-Encoding"))
+		}
+	}
+	res, _ = postBody(t, h, []byte("not gzip data"), "gzip")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf(
+			"\nexpected status code %d, got %d\n",
+			http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+// TestRequestHandlerLimit posts compressed bodies to handlers wrapped
+// with NewRequestHandlerLimit and checks that bodies exceeding the
+// limits result in 413 Request Entity Too Large status and a
+// *BodyLimitError from the request Body's Read method.
+func TestRequestHandlerLimit(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bomb := make([]byte, 8<<20)
+	for _, tc := range []struct {
+		body     []byte
+		maxSize  int64
+		maxRatio float64
+		resCode  int
+	}{
+		{data, 4096, 0, http.StatusOK},
+		{data, 4095, 0, http.StatusRequestEntityTooLarge},
+		{bomb, 0, 100, http.StatusRequestEntityTooLarge},
+		{bomb, 0, 10000, http.StatusOK},
+	} {
+		errc := make(chan error, 1)
+		h, err := httpgzip.NewRequestHandlerLimit(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				_, err := io.Copy(ioutil.Discard, r.Body)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+				errc <- err
+			}), tc.maxSize, tc.maxRatio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _ := postBody(t, h, gzipData(t, tc.body), "gzip")
+		if res.StatusCode != tc.resCode {
+			t.Fatalf(
+				"\nlimits %d, %g, expected status code %d, got %d\n",
+				tc.maxSize, tc.maxRatio, tc.resCode, res.StatusCode)
+		}
+		readErr := <-errc
+		_, isLimitErr := readErr.(*httpgzip.BodyLimitError)
+		if isLimitErr != (tc.resCode != http.StatusOK) {
+			t.Fatalf(
+				"\nlimits %d, %g, unexpected read error %v\n",
+				tc.maxSize, tc.maxRatio, readErr)
+		}
+	}
+	if _, err := httpgzip.NewRequestHandlerLimit(echoHandler, -1, 0); err == nil {
+		t.Fatalf("\nexpected error for negative limit\n")
+	}
+}
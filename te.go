@@ -0,0 +1,38 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import "net/http"
+
+// acceptsGzipTransfer reports whether the response to r, whose
+// accepted content codings are encs, may be compressed using the gzip
+// transfer coding. Transfer codings only exist in HTTP/1.1, and the
+// response must be acceptable to the client if it is not compressed.
+//
+// ref: https://tools.ietf.org/html/rfc7230#section-4.3
+func acceptsGzipTransfer(r *http.Request, encs []encoding) bool {
+	if r.ProtoMajor != 1 || r.ProtoMinor < 1 {
+		return false
+	}
+	te := r.Header.Get("TE")
+	if te == "" {
+		return false
+	}
+	if q, ok := parseAcceptEncoding(te)["gzip"]; !ok || q == 0 {
+		return false
+	}
+	for _, e := range encs {
+		if e == encIdentity {
+			return true
+		}
+	}
+	return false
+}
+
+// identityOK reports whether the response may be sent without
+// compression.
+func (w *gzipResponseWriter) identityOK() bool {
+	return w.te || len(w.encs) > 1
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xi2/httpgzip"
+)
+
+// getRaw sends an HTTP/1.1 GET request for path with the given
+// headers to the server at addr over a new connection, and returns
+// the response's status code, headers and body with any chunked
+// transfer coding removed. It is needed because http.Client does not
+// support the gzip transfer coding.
+func getRaw(t *testing.T, addr, path string, headers []string) (int, textproto.MIMEHeader, []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n",
+		path, addr)
+	for _, h := range headers {
+		fmt.Fprintf(conn, "%s\r\n", h)
+	}
+	fmt.Fprintf(conn, "\r\n")
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	line, err := tp.ReadLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	if _, err := fmt.Sscanf(line, "HTTP/1.1 %d", &code); err != nil {
+		t.Fatal(err)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	te := header.Values("Transfer-Encoding")
+	var body []byte
+	if len(te) > 0 && te[len(te)-1] == "chunked" {
+		body, err = ioutil.ReadAll(httputil.NewChunkedReader(tp.R))
+	} else {
+		body, err = ioutil.ReadAll(tp.R)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, header, body
+}
+
+// TestTransferCoding requests files from an http.FileServer wrapped
+// by a handler whose Config has TransferCoding true, and checks that
+// the gzip transfer coding is used for requests whose TE header
+// accepts it, leaving Content-Encoding, ETag and Range requests
+// alone.
+func TestTransferCoding(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &httpgzip.Config{TransferCoding: true}
+	gzh, err := httpgzip.NewHandlerConfig(
+		http.FileServer(http.Dir("testdata")), nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gzh)
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+	for _, tc := range []struct {
+		headers []string
+		code    int
+		te      string
+		ce      string
+		body    []byte
+	}{
+		{[]string{"TE: gzip", "Accept-Encoding: identity"},
+			http.StatusOK, "gzip, chunked", "", data},
+		{[]string{"TE: gzip;q=0.5, trailers", "Accept-Encoding: gzip"},
+			http.StatusOK, "gzip, chunked", "", data},
+		{[]string{"TE: gzip", "Range: bytes=100-999"},
+			http.StatusPartialContent, "gzip, chunked", "", data[100:1000]},
+		{[]string{"TE: gzip;q=0", "Accept-Encoding: gzip"},
+			http.StatusOK, "chunked", "gzip", data},
+		{[]string{"TE: gzip", "Accept-Encoding: gzip, identity;q=0"},
+			http.StatusOK, "chunked", "gzip", data},
+		{[]string{"TE: trailers"},
+			http.StatusOK, "", "", data},
+	} {
+		code, header, body := getRaw(t, addr, "/4096bytes.txt", tc.headers)
+		te := strings.Join(header.Values("Transfer-Encoding"), ", ")
+		if code != tc.code || te != tc.te ||
+			header.Get("Content-Encoding") != tc.ce {
+			t.Fatalf("\nheaders %v\nexpected %d, %q, %q\ngot %d, %q, %q\n",
+				tc.headers, tc.code, tc.te, tc.ce,
+				code, te, header.Get("Content-Encoding"))
+		}
+		if te == "gzip, chunked" || tc.ce == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(body, tc.body) {
+			t.Fatalf("\nheaders %v\nbody differs\n", tc.headers)
+		}
+		if te == "gzip, chunked" && header.Get("Content-Length") != "" {
+			t.Fatalf("\nheaders %v\nunexpected Content-Length\n",
+				tc.headers)
+		}
+	}
+}
+
+// TestTransferCodingPadding checks that an HTML response using the
+// gzip transfer coding, with a Config whose BreachMitigation asks for
+// HTML padding, is padded in the gzip header rather than in its
+// content, which is a byte range.
+func TestTransferCodingPadding(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+	c := &httpgzip.Config{
+		TransferCoding: true,
+		Breach: &httpgzip.BreachMitigation{
+			Padding:     64,
+			HTMLPadding: true,
+		},
+	}
+	gzh, err := httpgzip.NewHandlerConfig(h, nil, defComp, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(gzh)
+	defer ts.Close()
+	code, _, body := getRaw(t, ts.Listener.Addr().String(), "/",
+		[]string{"TE: gzip", "Range: bytes=0-599"})
+	if code != http.StatusPartialContent {
+		t.Fatalf("\nexpected status %d, got %d\n",
+			http.StatusPartialContent, code)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err = ioutil.ReadAll(zr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, data[:600]) {
+		t.Fatalf("\nbody differs, got %d bytes ending %q\n",
+			len(body), body[len(body)-20:])
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A Transport is an http.RoundTripper which wraps another
+// http.RoundTripper adding transparent decoding of response bodies.
+//
+// Unless a request already has an Accept-Encoding header, or has a
+// Range header, Transport sets its Accept-Encoding header to the
+// content codings it can decode: gzip, deflate and any registered
+// with RegisterDecoder. Responses encoded with those codings have
+// their Body replaced by a *DecodedBody, their Content-Encoding and
+// Content-Length headers removed, their ContentLength set to -1 and
+// their Uncompressed field set to true. This happens regardless of
+// who set the request's Accept-Encoding header. Responses using a
+// coding which cannot be decoded are returned untouched.
+type Transport struct {
+	// Transport is the http.RoundTripper used to make requests. If
+	// nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+	// Presets are preset DEFLATE dictionaries used to decode
+	// responses. Their content codings are added to the
+	// Accept-Encoding header set by Transport, and responses using
+	// them are decoded using whichever dictionary the response
+	// names.
+	Presets []*PresetDictionary
+}
+
+// acceptEncoding returns the value of the Accept-Encoding header set
+// by t.
+func (t *Transport) acceptEncoding() string {
+	ae := supportedCodings()
+	added := map[string]bool{}
+	for _, p := range t.Presets {
+		c := strings.ToLower(p.Coding)
+		if _, ok := decoder(c); !ok && !added[c] {
+			ae += ", " + c
+			added[c] = true
+		}
+	}
+	return ae
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" {
+		// a RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", t.acceptEncoding())
+	}
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == "HEAD" || res.Body == nil || res.Body == http.NoBody ||
+		res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusNotModified {
+		return res, nil
+	}
+	codings := parseCodings(
+		strings.Join(res.Header.Values("Content-Encoding"), ","))
+	if len(codings) == 0 {
+		return res, nil
+	}
+	for _, c := range codings {
+		if _, ok := decoder(c); !ok && presetDicts(t.Presets, c) == nil {
+			return res, nil
+		}
+	}
+	res.Body = &DecodedBody{
+		d: &decodingReader{
+			body:    res.Body,
+			codings: codings,
+			presets: t.Presets,
+		},
+	}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// A DecodedBody is the Body of a response decoded by a Transport. As
+// well as decoding the response it records the response's original
+// content coding and counts the encoded bytes read.
+type DecodedBody struct {
+	d *decodingReader
+}
+
+func (b *DecodedBody) Read(p []byte) (int, error) {
+	return b.d.Read(p)
+}
+
+func (b *DecodedBody) Close() error {
+	return b.d.Close()
+}
+
+// Coding returns the original Content-Encoding of the response, such
+// as "gzip". Several codings are listed in the order they were
+// applied, separated by commas.
+func (b *DecodedBody) Coding() string {
+	return strings.Join(b.d.codings, ", ")
+}
+
+// CompressedBytes returns the number of encoded bytes read from the
+// response so far. Once the body has been read to EOF it is the
+// encoded size of the response body.
+func (b *DecodedBody) CompressedBytes() int64 {
+	if b.d.cr == nil {
+		return 0
+	}
+	return b.d.cr.n
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2015 The Httpgzip Authors.
+// Use of this source code is governed by an Expat-style
+// MIT license that can be found in the LICENSE file.
+
+package httpgzip_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xi2/httpgzip"
+)
+
+// getTransport starts a temporary test server using handler h and
+// issues a request for it using an httpgzip.Transport. The request
+// has the specified headers added. getTransport returns the
+// http.Response (with Body closed) and the result of reading the
+// response Body.
+func getTransport(t *testing.T, h http.Handler, headers []string) (*http.Response, []byte) {
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		req.Header.Add(parseHeader(h))
+	}
+	client := http.Client{Transport: &httpgzip.Transport{}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, body
+}
+
+// TestTransport requests a text file from handlers serving it with
+// various content codings using an httpgzip.Transport. It checks
+// that the responses are decoded and that the original coding is
+// recorded.
+func TestTransport(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpgzip.RegisterDecoder("X-Test", func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	})
+	for _, tc := range []struct {
+		enc  string
+		body []byte
+	}{
+		{"gzip", gzipData(t, data)},
+		{"deflate", zlibData(t, data)},
+		{"x-test", data},
+		{"", data},
+	} {
+		var acceptEnc string
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEnc = r.Header.Get("Accept-Encoding")
+			if tc.enc != "" {
+				w.Header().Set("Content-Encoding", tc.enc)
+			}
+			_, _ = w.Write(tc.body)
+		})
+		res, body := getTransport(t, h, nil)
+		for _, c := range []string{"gzip", "deflate", "x-test"} {
+			if !strings.Contains(acceptEnc, c) {
+				t.Fatalf(
+					"\nexpected %s in Accept-Encoding, got %s\n",
+					c, acceptEnc)
+			}
+		}
+		if !bytes.Equal(body, data) {
+			t.Fatalf("\nContent-Encoding %s, body not decoded\n", tc.enc)
+		}
+		if res.Header.Get("Content-Encoding") != "" ||
+			res.Header.Get("Content-Length") != "" && tc.enc != "" {
+			t.Fatalf(
+				"\nContent-Encoding %s, encoding headers not removed\n",
+				tc.enc)
+		}
+		db, ok := res.Body.(*httpgzip.DecodedBody)
+		if ok != (tc.enc != "") {
+			t.Fatalf(
+				"\nContent-Encoding %s, unexpected Body type %T\n",
+				tc.enc, res.Body)
+		}
+		if ok && (db.Coding() != tc.enc ||
+			db.CompressedBytes() != int64(len(tc.body))) {
+			t.Fatalf(
+				"\nContent-Encoding %s, got coding %s and %d compressed bytes\n",
+				tc.enc, db.Coding(), db.CompressedBytes())
+		}
+	}
+}
+
+// TestTransportPresetAcceptEncoding checks that an Accept-Encoding
+// header set on the request is left alone, and that responses are
+// still decoded.
+func TestTransportPresetAcceptEncoding(t *testing.T) {
+	data, err := ioutil.ReadFile(
+		filepath.Join("testdata", "4096bytes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzh := httpgzip.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept-Encoding") != "gzip, identity;q=0.5" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write(data)
+		}), nil)
+	res, body :=
+		getTransport(t, gzh, []string{"Accept-Encoding: gzip, identity;q=0.5"})
+	if res.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf(
+			"\nexpected status code %d and decoded body, got %d\n",
+			http.StatusOK, res.StatusCode)
+	}
+	if _, ok := res.Body.(*httpgzip.DecodedBody); !ok {
+		t.Fatalf("\nexpected gzip encoded response\n")
+	}
+}